@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const jq_args_usage = `  -arg name value
+    	set $name to the string value
+  -argjson name json
+    	set $name to the json value
+  -slurpfile name filename
+    	set $name to an array of all the documents in the file (in any input format)
+  -rawfile name filename
+    	set $name to the contents of the file, as a string
+  -args
+    	treat the rest of the positional arguments as strings for $ARGS.positional, not files
+  -jsonargs
+    	treat the rest of the positional arguments as json values for $ARGS.positional, not files
+`
+
+// A jq variable given on the command line, before its value is worked out.
+type jq_arg struct {
+	kind  string // "arg", "argjson", "slurpfile" or "rawfile"
+	name  string
+	param string
+}
+
+// The command line, sorted into its parts.
+type cmdline struct {
+	flags      []string // for the flag package
+	expression string
+	files      []string
+	vars       []jq_arg
+	positional []string // after --args or --jsonargs
+	jsonargs   bool
+}
+
+// Splits up the command line, handling the jq options which the flag package
+// can't: the ones which take two parameters (--arg name value), and the ones
+// which change what the positional arguments mean (--args).  The rest of the
+// options are left for fs to parse, and can come before or after the
+// expression, like in jq.
+func split_cmdline(fs *flag.FlagSet, args []string) (*cmdline, error) {
+	c := &cmdline{}
+	have_expression := false
+	mode := "files"
+	positional := func(arg string) {
+		switch {
+		case !have_expression:
+			c.expression = arg
+			have_expression = true
+		case mode == "files":
+			c.files = append(c.files, arg)
+		default:
+			c.positional = append(c.positional, arg)
+		}
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			for _, rest := range args[i+1:] {
+				positional(rest)
+			}
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			positional(arg)
+			continue
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		switch name {
+		case "arg", "argjson", "slurpfile", "rawfile":
+			if i+2 >= len(args) {
+				return nil, fmt.Errorf("%s needs two parameters: a variable name and a value", arg)
+			}
+			c.vars = append(c.vars, jq_arg{kind: name, name: args[i+1], param: args[i+2]})
+			i += 2
+			continue
+		case "args", "jsonargs":
+			mode = name
+			c.jsonargs = name == "jsonargs"
+			continue
+		}
+
+		// jq also takes -Ldir, with no space
+		if strings.HasPrefix(arg, "-L") && len(arg) > 2 && fs.Lookup(name) == nil {
+			c.flags = append(c.flags, "-L="+arg[2:])
+			continue
+		}
+
+		// an ordinary flag; take its value along with it, if it has one
+		c.flags = append(c.flags, arg)
+		if strings.Contains(name, "=") {
+			continue
+		}
+		if f := fs.Lookup(name); f != nil {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+				continue
+			}
+			if i+1 < len(args) {
+				c.flags = append(c.flags, args[i+1])
+				i++
+			}
+		}
+	}
+	return c, nil
+}
+
+// Works out the values of the jq variables given on the command line, and
+// sets them up to be passed to the expression, along with $ARGS.
+func (a *App) setup_variables(c *cmdline) {
+	named := map[string]any{}
+	for _, v := range c.vars {
+		var value any
+		var err error
+		switch v.kind {
+		case "arg":
+			value = v.param
+		case "argjson":
+			value, err = formats["json"].Input([]byte(v.param))
+			value = normalize(value)
+		case "slurpfile":
+			file := a.new_input_file(v.param, "auto")
+			value, _ = (&slurpIter{inner: &inputIter{files: []inputFile{file}, log: a.log}}).Next()
+			err, _ = value.(error)
+		case "rawfile":
+			var raw []byte
+			raw, err = os.ReadFile(v.param)
+			value = string(raw)
+		}
+		if err != nil {
+			a.log.WithError(err).Fatalf("could not set up $%s from --%s", v.name, v.kind)
+		}
+		a.varnames = append(a.varnames, "$"+v.name)
+		a.varvalues = append(a.varvalues, value)
+		named[v.name] = value
+	}
+
+	positional := []any{}
+	for _, arg := range c.positional {
+		if !c.jsonargs {
+			positional = append(positional, arg)
+			continue
+		}
+		value, err := formats["json"].Input([]byte(arg))
+		value = normalize(value)
+		if err != nil {
+			a.log.WithError(err).Fatalf("could not decode %q from --jsonargs", arg)
+		}
+		positional = append(positional, value)
+	}
+
+	a.varnames = append(a.varnames, "$ARGS")
+	a.varvalues = append(a.varvalues, map[string]any{
+		"named":      named,
+		"positional": positional,
+	})
+}
@@ -1,6 +1,17 @@
 package main
 
-import "go.mongodb.org/mongo-driver/bson"
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 type BSONFormat struct {
 }
@@ -19,21 +30,264 @@ func (f *BSONFormat) GetFeatures() FormatFeatures {
 		Can_output:      true,
 		Can_prettyprint: false,
 		Can_scalar:      false,
-		Can_array:       false,
+		Can_array:       true, // of documents, one after another
 		Can_object:      true,
+		Can_multidoc:    true,
 		Is_binary:       true,
 		Arbitrary_tree:  true,
 		Universal:       true,
 	}
 }
 
+func (f *BSONFormat) NativeTypes() NativeTypes {
+	return NativeTypes{Dates: true, Binary: true, BSON: true}
+}
+
 func (f *BSONFormat) Input(b []byte) (any, error) {
-	var data any
-	err := bson.Unmarshal(b, &data)
-	return data, err
+	// a single document, or an array of them if there's more than one (or
+	// none, like the dump of an empty collection)
+	docs := []any{}
+	dec := f.NewDecoder(bytes.NewReader(b))
+	for {
+		doc, err := dec.Decode()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("document %d: %w", len(docs), err)
+		}
+		docs = append(docs, doc)
+	}
+	if len(docs) == 1 {
+		return docs[0], nil
+	}
+	return docs, nil
 }
 
 func (f *BSONFormat) Output(a any, _ bool) ([]byte, error) {
-	rv, err := bson.Marshal(a)
+	arr, ok := a.([]any)
+	if !ok {
+		arr = []any{a}
+	}
+	// an array is written as its documents, one after another
+	b := []byte{}
+	for _, value := range arr {
+		if _, ok := value.(map[string]any); !ok {
+			return nil, fmt.Errorf("bson output only supports objects, or arrays of them, at the top level")
+		}
+		doc, err := bson_value(value, "")
+		if err != nil {
+			return nil, err
+		}
+		if b, err = bson.MarshalAppend(b, doc); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Gets a value ready for the bson encoder: objects become documents with their
+// keys in the order they were read in (see keyOrder), and integers get the
+// type they were read as (see intTypes), or if they weren't, int32 or int64 by
+// size, and decimal128 when they're too big for an int64.
+func bson_value(v any, path string) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		doc := make(bson.D, 0, len(v))
+		for _, key := range bson_key_order.sorted(path, v) {
+			value, err := bson_value(v[key], path+"\x00"+key)
+			if err != nil {
+				return nil, err
+			}
+			doc = append(doc, bson.E{Key: key, Value: value})
+		}
+		return doc, nil
+	case []any:
+		arr := make(bson.A, len(v))
+		for i, value := range v {
+			value, err := bson_value(value, path)
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = value
+		}
+		return arr, nil
+	case primitive.CodeWithScope:
+		scope, err := bson_value(v.Scope, path)
+		return primitive.CodeWithScope{Code: v.Code, Scope: scope}, err
+	case int:
+		switch bson_int_types[path] {
+		case bsontype.Int64:
+			return int64(v), nil
+		case bsontype.Decimal128:
+			return bson_decimal(big.NewInt(int64(v)))
+		}
+	case *big.Int:
+		if v.IsInt64() && bson_int_types[path] == bsontype.Int64 {
+			return v.Int64(), nil
+		}
+		return bson_decimal(v)
+	}
+	return v, nil
+}
+
+func bson_decimal(n *big.Int) (any, error) {
+	// a decimal128 has 34 digits
+	d, err := primitive.ParseDecimal128(n.String())
+	if err != nil {
+		return nil, fmt.Errorf("bson cannot represent %s: %w", n, err)
+	}
+	return d, nil
+}
+
+// Converts a bson document, noting the order of its keys and the types of its
+// integers, since jq's objects and numbers don't keep them.
+func bson_document(doc bson.Raw, path string) (map[string]any, error) {
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+	obj := make(map[string]any, len(elems))
+	keys := make([]string, len(elems))
+	for i, elem := range elems {
+		keys[i] = elem.Key()
+		if obj[keys[i]], err = bson_raw_value(elem.Value(), path+"\x00"+keys[i]); err != nil {
+			return nil, err
+		}
+	}
+	bson_key_order.learn(path, keys)
+	return obj, nil
+}
+
+func bson_raw_value(v bson.RawValue, path string) (any, error) {
+	switch v.Type {
+	case bsontype.EmbeddedDocument:
+		return bson_document(v.Document(), path)
+	case bsontype.Array:
+		values, err := v.Array().Values()
+		if err != nil {
+			return nil, err
+		}
+		arr := make([]any, len(values))
+		for i, value := range values {
+			if arr[i], err = bson_raw_value(value, path); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	case bsontype.Int32, bsontype.Int64:
+		bson_int_types.learn(path, v.Type)
+	case bsontype.Decimal128:
+		// integers are numbers, like the other integer types; the rest stay
+		// as {"$numberDecimal": "..."}
+		if n, exp, err := v.Decimal128().BigInt(); err == nil && exp >= 0 {
+			bson_int_types.learn(path, v.Type)
+			return big_int(n.Mul(n, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil))), nil
+		}
+	case bsontype.CodeWithScope:
+		code, scope := v.CodeWithScope()
+		doc, err := bson_document(scope, path)
+		return primitive.CodeWithScope{Code: primitive.JavaScript(code), Scope: doc}, err
+	}
+	var rv any
+	err := v.Unmarshal(&rv)
 	return rv, err
 }
+
+// The order in which the keys of bson and ejson documents were read, so that
+// they're written back in it.  Objects at the same path (array indices aside)
+// share an order, merged from all of them, so a key which only some of them
+// have goes where it turned up.  Keys which were never read go last, sorted.
+type keyOrder map[string][]string
+
+var bson_key_order = keyOrder{}
+
+func (o keyOrder) learn(path string, keys []string) {
+	order := o[path]
+	for i, key := range keys {
+		if key_index(order, key) >= 0 {
+			continue
+		}
+		// before the next key which is already known, or at the end
+		pos := len(order)
+		for _, next := range keys[i+1:] {
+			if j := key_index(order, next); j >= 0 {
+				pos = j
+				break
+			}
+		}
+		order = append(order[:pos], append([]string{key}, order[pos:]...)...)
+	}
+	o[path] = order
+}
+
+func (o keyOrder) sorted(path string, obj map[string]any) []string {
+	keys := sorted_keys(obj)
+	order := o[path]
+	rank := func(key string) int {
+		if i := key_index(order, key); i >= 0 {
+			return i
+		}
+		return len(order)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return rank(keys[i]) < rank(keys[j])
+	})
+	return keys
+}
+
+// The types which integers at each path (array indices aside) were read as,
+// int32, int64 or decimal128, so that they're written back as them.  Where
+// they were mixed, the type is 0, and it's picked by size again.
+type intTypes map[string]bsontype.Type
+
+var bson_int_types = intTypes{}
+
+func (t intTypes) learn(path string, typ bsontype.Type) {
+	if old, ok := t[path]; !ok {
+		t[path] = typ
+	} else if old != typ {
+		t[path] = 0
+	}
+}
+
+func key_index(keys []string, key string) int {
+	for i, k := range keys {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// MongoDB's limit on the size of a document, which is checked before the
+// length at the start of one is trusted enough to allocate that much.
+const bson_max_size = 16 * 1024 * 1024
+
+func (f *BSONFormat) NewDecoder(r io.Reader) DocumentDecoder {
+	// each document starts with its own length (int32, little endian), so
+	// files like mongodump output are just documents one after another
+	return decoderFunc(func() (any, error) {
+		lenbuf := make([]byte, 4)
+		n, err := io.ReadFull(r, lenbuf)
+		if err == io.EOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, fmt.Errorf("truncated bson document length (%d bytes): %w", n, err)
+		}
+		doclen := int32(binary.LittleEndian.Uint32(lenbuf))
+		if doclen < 5 {
+			return nil, fmt.Errorf("invalid bson document length %d", doclen)
+		} else if doclen > bson_max_size {
+			return nil, fmt.Errorf("bson document length %d is over the maximum of %d", doclen, bson_max_size)
+		}
+		doc := make([]byte, doclen)
+		copy(doc, lenbuf)
+		if _, err := io.ReadFull(r, doc[4:]); err != nil {
+			return nil, fmt.Errorf("truncated bson document: %w", err)
+		}
+		if err := bson.Raw(doc).Validate(); err != nil {
+			return nil, err
+		}
+		return bson_document(doc, "")
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The SGR parameters (like "1;31") used for each kind of token, in the same
+// order as jq's JQ_COLORS.  Comments use the null color, and xml tags and
+// ini/toml section headers use the object color.
+type Colors struct {
+	Null   string
+	False  string
+	True   string
+	Number string
+	String string
+	Array  string
+	Object string
+	Key    string
+}
+
+var default_colors = Colors{
+	Null:   "0;90",
+	False:  "0;39",
+	True:   "0;39",
+	Number: "0;39",
+	String: "0;32",
+	Array:  "1;39",
+	Object: "1;39",
+	Key:    "34;1",
+}
+
+var sgr_re = regexp.MustCompile(`^[0-9;]*$`)
+
+// Parses a color list in the style of JQ_COLORS: colon-separated SGR
+// parameters for null, false, true, numbers, strings, arrays, objects and
+// object keys.  Ones which are left off keep their default.
+func parse_colors(spec string) (Colors, error) {
+	c := default_colors
+	if spec == "" {
+		return c, nil
+	}
+	fields := []*string{&c.Null, &c.False, &c.True, &c.Number, &c.String, &c.Array, &c.Object, &c.Key}
+	parts := strings.Split(spec, ":")
+	if len(parts) > len(fields) {
+		return default_colors, fmt.Errorf("expected at most %d colors, got %d", len(fields), len(parts))
+	}
+	for i, part := range parts {
+		if !sgr_re.MatchString(part) {
+			return default_colors, fmt.Errorf("%q is not a valid color", part)
+		}
+		*fields[i] = part
+	}
+	return c, nil
+}
+
+// Writes text to w in the given color.
+func (c *Colors) paint(w *bytes.Buffer, sgr string, text []byte) {
+	if len(text) == 0 {
+		return
+	}
+	w.WriteString("\x1b[" + sgr + "m")
+	w.Write(text)
+	w.WriteString("\x1b[0m")
+}
+
+var (
+	color_number_re = regexp.MustCompile(`^[+-]?(\.?[0-9][0-9_]*(\.[0-9_]*)?([eE][+-]?[0-9_]+)?|0x[0-9A-Fa-f_]+|0o[0-7_]+|0b[01_]+|\.?(inf|Inf|INF|nan|NaN|NAN))$`)
+	color_date_re   = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}([Tt ]?[0-9:.]*([Zz]|[+-]\d{2}:?\d{2})?)?$|^\d{2}:\d{2}:\d{2}(\.\d+)?([Zz]|[+-]\d{2}:?\d{2})?$`)
+)
+
+// Picks the color for an unquoted scalar, in the formats which have them.
+// Anything which isn't null, a boolean or a number is a string.
+func (c *Colors) scalar(text []byte) string {
+	if sgr, ok := c.literal(text); ok {
+		return sgr
+	}
+	return c.String
+}
+
+// Picks the color for null, a boolean, a number or a date, if text is one.
+func (c *Colors) literal(text []byte) (string, bool) {
+	switch string(text) {
+	case "null", "Null", "NULL", "~":
+		return c.Null, true
+	case "true", "True", "TRUE":
+		return c.True, true
+	case "false", "False", "FALSE":
+		return c.False, true
+	}
+	if color_number_re.Match(text) || color_date_re.Match(text) {
+		return c.Number, true
+	}
+	return "", false
+}
+
+// Returns the length of the quoted string at the start of b, which starts
+// with quote.  Backslash escapes are skipped over if escapes is set.  If the
+// string doesn't end, that's the rest of b.
+func quoted_len(b []byte, quote string, escapes bool) int {
+	for i := len(quote); i < len(b); i++ {
+		if escapes && b[i] == '\\' {
+			i++
+			continue
+		}
+		if bytes.HasPrefix(b[i:], []byte(quote)) {
+			return i + len(quote)
+		}
+	}
+	return len(b)
+}
@@ -3,15 +3,46 @@ package main
 import (
 	"bytes"
 	"encoding/csv"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
-	"sort"
+	"math/big"
+	"regexp"
 	"strconv"
+	"strings"
 )
 
 type CSVFormat struct {
+	Infer bool              // guess the types of cells, rather than keeping them all as strings
+	Types map[string]string // the types of particular columns, by header
+
+	Delimiter        rune     // for input; 0 means the format's own (comma for csv, tab for tsv)
+	OutputDelimiter  rune     // the same, for output; 0 also means Delimiter, if the input was the same format
+	NoHeader         bool     // rows are arrays, with no header row
+	Comment          rune     // lines starting with this are skipped; 0 means none
+	LazyQuotes       bool     // allow quotes in unquoted fields, and unescaped ones in quoted fields
+	TrimLeadingSpace bool     // ignore spaces at the start of fields
+	Ragged           string   // what to do with rows of the wrong length: "error", "pad" or "truncate"
+	CRLF             bool     // end output lines with \r\n
+	Columns          []string // which columns to write, in order; nil means all of them
+
+	header []string // of the last file read, so columns can be put back in the same order
+	readAs rune     // the default delimiter of the format the last file was read as
+
+	Arrays        string // how to write nested arrays: "index" (a.0, a.1) or "join"
+	JoinSeparator string // between array elements, when they're joined
+	Unflatten     bool   // turn dotted headers back into nested objects when reading
+}
+
+// The same as csv, but separated by tabs.  It shares csv's options.
+type TSVFormat struct {
+	*CSVFormat
 }
 
+// csv and tsv share this, so the --csv-* options apply to both.
+var csv_format = &CSVFormat{Ragged: "error", Arrays: "index", JoinSeparator: ";"}
+
 func (f *CSVFormat) GetExtensions() []string {
 	return []string{
 		"csv",
@@ -26,50 +57,288 @@ func (f *CSVFormat) GetFeatures() FormatFeatures {
 		Can_scalar:      false,
 		Can_array:       true,
 		Can_object:      false,
+		Can_multidoc:    false,
 		Is_binary:       false,
 		Arbitrary_tree:  false,
 		Universal:       false, // header lines are not universal
 	}
 }
 
+func (f *TSVFormat) GetExtensions() []string {
+	return []string{
+		"tsv",
+		"tab",
+	}
+}
+
+func (f *TSVFormat) AddFlags(fs *flag.FlagSet) {
+	// the csv ones cover it
+}
+
+func (f *TSVFormat) Input(in []byte) (any, error) {
+	return f.input(in, '\t')
+}
+
+func (f *TSVFormat) Output(a any, _ bool) ([]byte, error) {
+	return f.output(a, '\t')
+}
+
+func (f *CSVFormat) AddFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&f.Infer, "csv-infer", false, "csv input: turn cells which look like numbers and booleans into those, and empty cells into null")
+	fs.Func("csv-types", "csv input: types of particular columns, like age=int,active=bool (types are string, int, float, bool and auto)", func(s string) error {
+		if f.Types == nil {
+			f.Types = map[string]string{}
+		}
+		for _, decl := range strings.Split(s, ",") {
+			column, typ, ok := strings.Cut(decl, "=")
+			if !ok {
+				return fmt.Errorf("expected column=type, not %q", decl)
+			}
+			switch typ {
+			case "string", "int", "float", "bool", "auto":
+				f.Types[column] = typ
+			default:
+				return fmt.Errorf("unknown type %q for column %q", typ, column)
+			}
+		}
+		return nil
+	})
+	fs.Func("csv-delimiter", "csv input: the character between fields (default , for csv and tab for tsv)", func(s string) error {
+		r, err := csv_char(s)
+		f.Delimiter = r
+		return err
+	})
+	fs.Func("csv-output-delimiter", "csv output: the character between fields (default --csv-delimiter when the input is the same format, otherwise , for csv and tab for tsv)", func(s string) error {
+		r, err := csv_char(s)
+		f.OutputDelimiter = r
+		return err
+	})
+	fs.BoolVar(&f.NoHeader, "csv-no-header", false, "csv input and output: there's no header row, and rows are arrays")
+	fs.Func("csv-comment", "csv input: skip lines starting with this character, like #", func(s string) error {
+		r, err := csv_char(s)
+		f.Comment = r
+		return err
+	})
+	fs.BoolVar(&f.LazyQuotes, "csv-lazy-quotes", false, "csv input: allow stray quotes in fields")
+	fs.BoolVar(&f.TrimLeadingSpace, "csv-trim-leading-space", false, "csv input: ignore spaces at the start of fields")
+	fs.Func("csv-ragged", "csv input: what to do with rows with the wrong number of fields: error, pad (short rows) or truncate (long rows, and pad short ones) (default error)", func(s string) error {
+		switch s {
+		case "error", "pad", "truncate":
+			f.Ragged = s
+			return nil
+		}
+		return fmt.Errorf("expected error, pad or truncate")
+	})
+	fs.BoolVar(&f.CRLF, "csv-crlf", false, "csv output: end lines with CRLF, rather than LF")
+	fs.Func("csv-arrays", "csv output: how to write arrays inside rows: index (a column for each element, like tags.0) or join (one column, see --csv-join-separator) (default index)", func(s string) error {
+		switch s {
+		case "index", "join":
+			f.Arrays = s
+			return nil
+		}
+		return fmt.Errorf("expected index or join")
+	})
+	fs.StringVar(&f.JoinSeparator, "csv-join-separator", f.JoinSeparator, "csv output: separator between array elements, with --csv-arrays join")
+	fs.Func("csv-columns", "csv output: write just these columns, in this order, like name,spec.replicas", func(s string) error {
+		f.Columns = strings.Split(s, ",")
+		return nil
+	})
+	fs.BoolVar(&f.Unflatten, "csv-unflatten", false, "csv input: turn dotted headers like spec.replicas back into nested objects and arrays")
+}
+
+// Parses a single character option, which can be given as \t or "tab" too.
+func csv_char(s string) (rune, error) {
+	switch s {
+	case "\\t", "tab":
+		return '\t', nil
+	}
+	runes := []rune(s)
+	if len(runes) != 1 {
+		return 0, fmt.Errorf("expected a single character")
+	}
+	return runes[0], nil
+}
+
 func (f *CSVFormat) Input(in []byte) (any, error) {
-	// always returns a slice of string maps.
-	b := bytes.NewBuffer(in)
-	r := csv.NewReader(b)
+	return f.input(in, ',')
+}
+
+// Returns an array of objects, or with --csv-no-header, an array of arrays.
+// comma is the default delimiter, if --csv-delimiter wasn't given.
+func (f *CSVFormat) input(in []byte, comma rune) (any, error) {
+	r := csv.NewReader(bytes.NewReader(in))
+	r.Comma = f.delimiter(f.Delimiter, comma)
+	f.readAs = comma
+	r.Comment = f.Comment
+	r.LazyQuotes = f.LazyQuotes
+	r.TrimLeadingSpace = f.TrimLeadingSpace
+	r.FieldsPerRecord = -1 // see fit_row
+
 	// header row
-	headers, err := r.Read()
-	if err != nil {
-		return nil, fmt.Errorf("could not read CSV header row: %v", err)
+	var headers []string
+	var err error
+	if !f.NoHeader {
+		headers, err = r.Read()
+		if err != nil {
+			return nil, fmt.Errorf("could not read CSV header row: %v", err)
+		}
+		f.header = headers
 	}
 
-	rownum := 1
 	rv := []any{}
 	for {
-		rownum += 1
 		rowarray, err := r.Read()
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return nil, fmt.Errorf("csv.Reader.Read returned %v", err)
 		}
-		if len(rowarray) > len(headers) {
-			return nil, fmt.Errorf("csv row %d has more fields than the header", rownum)
+		line, _ := r.FieldPos(0)
+		if f.NoHeader && headers == nil {
+			// the first row sets the width
+			headers = make([]string, len(rowarray))
+			for i := range headers {
+				headers[i] = strconv.Itoa(i)
+			}
 		}
-		rowmap := map[string]any{}
+		rowarray, err = f.fit_row(rowarray, len(headers))
+		if err != nil {
+			return nil, fmt.Errorf("csv line %d %w", line, err)
+		}
+
+		values := make([]any, len(rowarray))
 		for i, value := range rowarray {
-			header := headers[i]
-			rowmap[header] = value
+			values[i], err = f.convert(headers[i], value)
+			if err != nil {
+				return nil, fmt.Errorf("csv line %d, column %q: %w", line, headers[i], err)
+			}
+		}
+		if f.NoHeader {
+			rv = append(rv, values)
+			continue
+		}
+		rowmap := map[string]any{}
+		for i, value := range values {
+			rowmap[headers[i]] = value
+		}
+		if f.Unflatten {
+			rv = append(rv, csv_unflatten(rowmap))
+			continue
 		}
 		rv = append(rv, rowmap)
 	}
 	return rv, nil
 }
 
+// Returns the delimiter from an option, or comma if it wasn't given.
+func (f *CSVFormat) delimiter(option, comma rune) rune {
+	if option != 0 {
+		return option
+	}
+	return comma
+}
+
+// Makes a row the same width as the header, according to --csv-ragged.
+func (f *CSVFormat) fit_row(row []string, width int) ([]string, error) {
+	if len(row) > width {
+		if f.Ragged != "truncate" {
+			return nil, fmt.Errorf("has %d fields, but the header has %d (see --csv-ragged)", len(row), width)
+		}
+		return row[:width], nil
+	}
+	if len(row) < width {
+		if f.Ragged == "error" {
+			return nil, fmt.Errorf("has %d fields, but the header has %d (see --csv-ragged)", len(row), width)
+		}
+		for len(row) < width {
+			row = append(row, "")
+		}
+	}
+	return row, nil
+}
+
+// json-style numbers.  Anything else, like 007 or +5 or .5, stays a string,
+// since it's probably a code (like a zip code) rather than a quantity.
+var csv_int_re = regexp.MustCompile(`^-?(0|[1-9][0-9]*)$`)
+var csv_float_re = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// Converts a cell to the type declared for its column with --csv-types, or
+// the one it looks like with --csv-infer.
+func (f *CSVFormat) convert(header, value string) (any, error) {
+	typ, ok := f.Types[header]
+	if !ok {
+		typ = "string"
+		if f.Infer {
+			typ = "auto"
+		}
+	}
+	if typ == "string" {
+		return value, nil
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	switch typ {
+	case "int":
+		// unlike auto, this takes things like 02134 and +5 as well
+		if n, ok := new(big.Int).SetString(value, 10); ok {
+			return big_int(n), nil
+		}
+		return nil, fmt.Errorf("%q is not an integer", value)
+	case "float":
+		n, ok := parse_float(value)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		return n, nil
+	case "bool":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", value)
+		}
+		return b, nil
+	}
+
+	// auto
+	switch value {
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if n, ok := csv_int(value); ok {
+		return n, nil
+	}
+	if csv_float_re.MatchString(value) {
+		if n, ok := parse_float(value); ok {
+			return n, nil
+		}
+	}
+	return value, nil
+}
+
+// Parses a canonical integer, as an int if it fits, or a *big.Int if not.
+func csv_int(value string) (any, bool) {
+	if !csv_int_re.MatchString(value) || value == "-0" {
+		return nil, false
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		return n, true
+	}
+	n, ok := new(big.Int).SetString(value, 10)
+	return n, ok
+}
+
 type stringable interface {
 	String() string
 }
 
 func (f *CSVFormat) Output(a any, _ bool) ([]byte, error) {
+	return f.output(a, ',')
+}
+
+func (f *CSVFormat) output(a any, comma rune) ([]byte, error) {
 	// only supports a slice of string maps, or a slice of scalar slices.
 	b := bytes.NewBuffer([]byte{})
 
@@ -109,21 +378,17 @@ func (f *CSVFormat) Output(a any, _ bool) ([]byte, error) {
 	var headers []string
 	// if maps, find the key names
 	if found_map {
-		headermap := map[string]bool{}
-		for _, anything := range slice {
-			mapthing, ok := anything.(map[string]any)
-			if !ok {
-				return nil, fmt.Errorf("csv could not treat %v as map", anything)
+		rows := make([]any, len(slice))
+		columns := &csvColumns{seen: map[string]bool{}}
+		for i, anything := range slice {
+			flat := map[string]any{}
+			if err := f.flatten("", anything, flat, columns); err != nil {
+				return nil, err
 			}
-			for key := range mapthing {
-				headermap[key] = true
-			}
-		}
-		headers = make([]string, 0, len(headermap))
-		for key := range headermap {
-			headers = append(headers, key)
+			rows[i] = flat
 		}
-		sort.Strings(headers)
+		slice = rows
+		headers = f.order(columns.names)
 	}
 
 	if found_slice {
@@ -152,8 +417,16 @@ func (f *CSVFormat) Output(a any, _ bool) ([]byte, error) {
 	}
 
 	w := csv.NewWriter(b)
+	w.Comma = f.delimiter(f.OutputDelimiter, comma)
+	if f.OutputDelimiter == 0 && f.readAs == comma {
+		// the same format as the input, so the same dialect
+		w.Comma = f.delimiter(f.Delimiter, comma)
+	}
+	w.UseCRLF = f.CRLF
 	// emit header
-	w.Write(headers)
+	if !f.NoHeader {
+		w.Write(headers)
+	}
 
 	for _, rowthing := range slice {
 		rowany := []any{}
@@ -185,16 +458,248 @@ func (f *CSVFormat) Output(a any, _ bool) ([]byte, error) {
 		// convert any-array to string-array
 		rowstrings := make([]string, len(rowany))
 		for i, thing := range rowany {
-			if strthing, ok := thing.(string); ok {
-				rowstrings[i] = strthing
-			} else if strable, ok := thing.(stringable); ok {
-				rowstrings[i] = strable.String()
-			} else {
-				rowstrings[i] = fmt.Sprintf("%v", strthing)
+			cell, err := csv_cell(thing)
+			if err != nil {
+				return nil, err
 			}
+			rowstrings[i] = cell
 		}
 		w.Write(rowstrings)
 	}
 	w.Flush()
-	return b.Bytes(), nil
+	return b.Bytes(), w.Error()
+}
+
+// Formats a value for a single cell.  Nested arrays and objects, which only
+// get here in rows which are arrays, are written as json.
+func csv_cell(thing any) (string, error) {
+	switch thing := thing.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return thing, nil
+	case bool:
+		return strconv.FormatBool(thing), nil
+	case int:
+		return strconv.Itoa(thing), nil
+	case stringable:
+		return thing.String(), nil
+	}
+	// numbers come out the same way as in json
+	b, err := json.Marshal(thing)
+	return string(b), err
+}
+
+// Column names, in the order they first turn up.
+type csvColumns struct {
+	names []string
+	seen  map[string]bool
+}
+
+func (c *csvColumns) add(name string) {
+	if !c.seen[name] {
+		c.seen[name] = true
+		c.names = append(c.names, name)
+	}
+}
+
+// Puts the columns in order for writing.  That's the order given with
+// --csv-columns, if there was one.  Otherwise columns which were in the
+// header of the csv file read last stay in the same order, and new ones
+// come after them, in the order they first turn up.
+func (f *CSVFormat) order(names []string) []string {
+	if f.Columns != nil {
+		return f.Columns
+	}
+	present := map[string]bool{}
+	for _, name := range names {
+		present[name] = true
+	}
+	headers := []string{}
+	done := map[string]bool{}
+	for _, name := range f.header {
+		if present[name] && !done[name] {
+			headers = append(headers, name)
+			done[name] = true
+		}
+	}
+	for _, name := range names {
+		if !done[name] {
+			headers = append(headers, name)
+		}
+	}
+	return headers
+}
+
+// Dots and backslashes in keys get escaped with backslashes, so the headers
+// can be split up again by csv_unflatten.
+var csv_key_escaper = strings.NewReplacer(`\`, `\\`, `.`, `\.`)
+
+// Flattens the objects and arrays in a row into dotted paths, like
+// spec.replicas and tags.0, in flat.  The names are added to columns too.
+// Keys go in sorted order, since objects don't remember theirs.
+func (f *CSVFormat) flatten(prefix string, value any, flat map[string]any, columns *csvColumns) error {
+	path := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+	switch value := value.(type) {
+	case map[string]any:
+		if len(value) == 0 && prefix != "" {
+			flat[prefix] = "{}"
+			columns.add(prefix)
+		}
+		for _, key := range sorted_keys(value) {
+			if err := f.flatten(path(csv_key_escaper.Replace(key)), value[key], flat, columns); err != nil {
+				return err
+			}
+		}
+	case []any:
+		if len(value) == 0 {
+			flat[prefix] = "[]"
+			columns.add(prefix)
+			return nil
+		}
+		if f.Arrays == "join" && csv_all_scalars(value) {
+			cells := make([]string, len(value))
+			for i, child := range value {
+				cell, err := csv_cell(child)
+				if err != nil {
+					return err
+				}
+				cells[i] = cell
+			}
+			flat[prefix] = strings.Join(cells, f.JoinSeparator)
+			columns.add(prefix)
+			return nil
+		}
+		for i, child := range value {
+			if err := f.flatten(path(strconv.Itoa(i)), child, flat, columns); err != nil {
+				return err
+			}
+		}
+	case string:
+		if csv_marker_re.MatchString(value) {
+			// so it isn't mistaken for an empty array or object
+			value = `\` + value
+		}
+		flat[prefix] = value
+		columns.add(prefix)
+	default:
+		flat[prefix] = value
+		columns.add(prefix)
+	}
+	return nil
+}
+
+// The cells which flatten writes for empty arrays and objects, and strings
+// which look like them, which get another backslash in front.
+var csv_marker_re = regexp.MustCompile(`^\\*(\[\]|\{\})$`)
+
+func csv_all_scalars(arr []any) bool {
+	for _, value := range arr {
+		switch value.(type) {
+		case map[string]any, []any:
+			return false
+		}
+	}
+	return true
+}
+
+// The reverse of flatten: splits dotted headers up into nested objects.
+// Objects whose keys are all 0, 1, 2 and so on become arrays, and the "[]"
+// and "{}" which flatten writes for empty ones become those again, while
+// strings like "\[]" lose the backslash flatten added.  Empty cells in nested
+// columns are left out, since that's how flatten writes keys which some rows
+// don't have.
+func csv_unflatten(row map[string]any) any {
+	tree := map[string]any{}
+	for header, value := range row {
+		keys := csv_split_path(header)
+		if len(keys) > 1 && (value == nil || value == "") {
+			continue
+		}
+		switch str, _ := value.(string); {
+		case str == "[]":
+			value = []any{}
+		case str == "{}":
+			value = map[string]any{}
+		case csv_marker_re.MatchString(str):
+			value = str[1:]
+		}
+		obj := tree
+		for _, key := range keys[:len(keys)-1] {
+			child, ok := obj[key].(map[string]any)
+			if !ok {
+				// anything else there must be empty, like the "tags" column
+				// next to tags.0 and tags.1
+				child = map[string]any{}
+				obj[key] = child
+			}
+			obj = child
+		}
+		last := keys[len(keys)-1]
+		if _, ok := obj[last].(map[string]any); ok && csv_empty(value) {
+			continue
+		}
+		obj[last] = value
+	}
+	return csv_arrays(tree)
+}
+
+func csv_empty(value any) bool {
+	switch value := value.(type) {
+	case nil:
+		return true
+	case string:
+		return value == ""
+	case []any:
+		return len(value) == 0
+	case map[string]any:
+		return len(value) == 0
+	}
+	return false
+}
+
+// Splits a header on the dots which aren't escaped, and unescapes the parts.
+func csv_split_path(header string) []string {
+	keys := []string{}
+	key := strings.Builder{}
+	for i := 0; i < len(header); i++ {
+		switch {
+		case header[i] == '\\' && i+1 < len(header):
+			i++
+			key.WriteByte(header[i])
+		case header[i] == '.':
+			keys = append(keys, key.String())
+			key.Reset()
+		default:
+			key.WriteByte(header[i])
+		}
+	}
+	return append(keys, key.String())
+}
+
+func csv_arrays(value any) any {
+	obj, ok := value.(map[string]any)
+	if !ok {
+		return value
+	}
+	for key, child := range obj {
+		obj[key] = csv_arrays(child)
+	}
+	if len(obj) == 0 {
+		return obj
+	}
+	arr := make([]any, len(obj))
+	for i := range arr {
+		child, ok := obj[strconv.Itoa(i)]
+		if !ok {
+			return obj
+		}
+		arr[i] = child
+	}
+	return arr
 }
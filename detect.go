@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+)
+
+var (
+	ini_section_re   = regexp.MustCompile(`^\[[^\[\]]+\]$`)
+	toml_table_re    = regexp.MustCompile(`^\[\[?[^\[\]]+\]\]?$`)
+	key_value_re     = regexp.MustCompile(`^([^=]+?)\s*=\s*(.*)$`)
+	toml_key_re      = regexp.MustCompile(`^([A-Za-z0-9_-]+|"[^"]*"|'[^']*')(\s*\.\s*([A-Za-z0-9_-]+|"[^"]*"|'[^']*'))*$`)
+	toml_scalar_re   = regexp.MustCompile(`^("([^"\\]|\\.)*"|'[^']*'|"""|'''|true|false|[+-]?(inf|nan)|[+-]?[0-9][0-9_]*(\.[0-9_]+)?([eE][+-]?[0-9_]+)?|0x[0-9A-Fa-f_]+|0o[0-7_]+|0b[01_]+|\d{4}-\d{2}-\d{2}([Tt ][0-9:.]+([Zz]|[+-]\d{2}:\d{2})?)?|\d{2}:\d{2}:\d{2}(\.\d+)?)\s*(#.*)?$`)
+	toml_compound_re = regexp.MustCompile(`^[\[{]`)
+)
+
+// Guess the format from the first few bytes of the input.  This is the last
+// resort, for when neither the filename nor the executable name says anything
+// useful.  Falls back to yaml, since that will take almost anything.
+func detect_fmt_by_content(head []byte) string {
+	if looks_like_bson(head) {
+		return "bson"
+	}
+
+	text := bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")) // utf-8 byte order mark
+	text = bytes.TrimLeft(text, " \t\r\n")
+	if len(text) == 0 {
+		return "yaml"
+	}
+	switch text[0] {
+	case '<':
+		return "xml"
+	case '{':
+		return "json"
+	case '[':
+		// could be a json array, or an ini/toml section header
+		var value any
+		err := json.NewDecoder(bytes.NewReader(text)).Decode(&value)
+		if err == nil || errors.Is(err, io.ErrUnexpectedEOF) {
+			return "json"
+		}
+	}
+
+	// ini and toml both have [section] headers and key = value lines.  a file
+	// which is all valid toml is toml, anything else like that is ini.
+	sawini, sawtoml := false, false
+	is_toml := true
+	lines := bytes.Split(text, []byte("\n"))
+	if len(lines) > 1 && !bytes.HasSuffix(text, []byte("\n")) {
+		lines = lines[:len(lines)-1] // the last one might be cut off
+	}
+	for _, line := range lines {
+		line = bytes.TrimSpace(line)
+		switch {
+		case len(line) == 0 || line[0] == '#':
+			continue
+		case line[0] == ';':
+			sawini = true
+			is_toml = false
+		case toml_table_re.Match(line):
+			sawini = true
+			if !ini_section_re.Match(line) {
+				sawtoml = true
+			}
+		case key_value_re.Match(line):
+			sawini = true
+			kv := key_value_re.FindSubmatch(line)
+			key, value := bytes.TrimSpace(kv[1]), kv[2]
+			if toml_key_re.Match(key) && (toml_scalar_re.Match(value) || toml_compound_re.Match(value)) {
+				sawtoml = true
+			} else {
+				is_toml = false
+			}
+		default:
+			// not ini or toml; maybe a multi-line toml value, maybe yaml
+			if !sawtoml {
+				return "yaml"
+			}
+		}
+	}
+	if sawtoml && is_toml {
+		return "toml"
+	}
+	if sawini {
+		return "ini"
+	}
+	return "yaml"
+}
+
+// BSON documents start with their length, and end with a NUL byte.  In
+// between, each element starts with a type byte and a NUL-terminated name.
+func looks_like_bson(head []byte) bool {
+	if len(head) < 5 {
+		return false
+	}
+	doclen := int(int32(binary.LittleEndian.Uint32(head)))
+	if doclen < 5 {
+		return false
+	}
+	if doclen == 5 {
+		return head[4] == 0
+	}
+	if doclen <= len(head) && head[doclen-1] != 0 {
+		return false
+	}
+	elemtype := head[4]
+	if !(elemtype >= 0x01 && elemtype <= 0x13) && elemtype != 0x7f && elemtype != 0xff {
+		return false
+	}
+	// the element name has to end somewhere
+	name := head[5:]
+	if len(name) > doclen-6 {
+		name = name[:doclen-6]
+	}
+	return bytes.IndexByte(name, 0) >= 0
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// MongoDB's extended json, which is json with the bson types written as
+// objects like {"$oid": "..."}.  Canonical mode writes every number that way
+// too, so their bson types survive; relaxed mode (what mongoexport writes by
+// default) uses plain json numbers where it can.  Either one reads both.
+type EJSONFormat struct {
+	Canonical bool
+}
+
+func (f *EJSONFormat) GetExtensions() []string {
+	if !f.Canonical {
+		return []string{} // they look just like the canonical ones
+	}
+	return []string{
+		"ejson",
+	}
+}
+
+func (f *EJSONFormat) GetFeatures() FormatFeatures {
+	return FormatFeatures{
+		Can_input:       true,
+		Can_output:      true,
+		Can_prettyprint: true,
+		Can_scalar:      false,
+		Can_array:       true, // of documents
+		Can_object:      true,
+		Can_multidoc:    true,
+		Is_binary:       false,
+		Arbitrary_tree:  true,
+		Universal:       true,
+	}
+}
+
+func (f *EJSONFormat) NativeTypes() NativeTypes {
+	return NativeTypes{Dates: true, Binary: true, BSON: true}
+}
+
+func (f *EJSONFormat) Input(b []byte) (any, error) {
+	if trimmed := bytes.TrimLeft(b, " \t\r\n"); len(trimmed) == 0 || trimmed[0] != '[' {
+		return ejson_document(b)
+	}
+	// like mongoexport --jsonArray
+	var raws []json.RawMessage
+	if err := json.Unmarshal(b, &raws); err != nil {
+		return nil, err
+	}
+	docs := make([]any, len(raws))
+	for i, raw := range raws {
+		doc, err := ejson_document(raw)
+		if err != nil {
+			return nil, fmt.Errorf("at [%d]: %w", i, err)
+		}
+		docs[i] = doc
+	}
+	return docs, nil
+}
+
+// Reads a document by way of bson, so it's converted the same way.
+func ejson_document(b []byte) (map[string]any, error) {
+	var doc bson.Raw
+	// relaxed parsing accepts the canonical forms too
+	if err := bson.UnmarshalExtJSON(b, false, &doc); err != nil {
+		return nil, err
+	}
+	return bson_document(doc, "")
+}
+
+func (f *EJSONFormat) Output(a any, prettyprint bool) ([]byte, error) {
+	b := bytes.NewBuffer([]byte{})
+	arr, isarray := a.([]any)
+	if !isarray {
+		arr = []any{a}
+	} else if prettyprint {
+		b.WriteString("[\n  ")
+	} else {
+		b.WriteString("[")
+	}
+	for i, value := range arr {
+		if _, ok := value.(map[string]any); !ok {
+			return nil, fmt.Errorf("ejson output only supports objects, or arrays of them, at the top level")
+		}
+		doc, err := bson_value(value, "")
+		if err != nil {
+			return nil, err
+		}
+		var out []byte
+		if prettyprint && isarray {
+			out, err = bson.MarshalExtJSONIndent(doc, f.Canonical, false, "  ", "  ")
+		} else if prettyprint {
+			out, err = bson.MarshalExtJSONIndent(doc, f.Canonical, false, "", "  ")
+		} else {
+			out, err = bson.MarshalExtJSON(doc, f.Canonical, false)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && prettyprint {
+			b.WriteString(",\n  ")
+		} else if i > 0 {
+			b.WriteString(",")
+		}
+		b.Write(out)
+	}
+	if isarray && prettyprint {
+		b.WriteString("\n]")
+	} else if isarray {
+		b.WriteString("]")
+	}
+	b.WriteString("\n")
+	return b.Bytes(), nil
+}
+
+func (f *EJSONFormat) NewDecoder(r io.Reader) DocumentDecoder {
+	// one document per line, like mongoexport writes, or any other
+	// concatenation of them
+	dec := json.NewDecoder(r)
+	return decoderFunc(func() (any, error) {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		return f.Input(raw)
+	})
+}
+
+func (f *EJSONFormat) Colorize(b []byte, c *Colors) []byte {
+	return (&JSONFormat{}).Colorize(b, c)
+}
@@ -6,7 +6,6 @@ require (
 	github.com/apex/log v1.9.0
 	github.com/itchyny/gojq v0.12.13
 	github.com/mattn/go-isatty v0.0.19
-	github.com/momiji/xqml v0.0.9
 	github.com/pelletier/go-toml/v2 v2.0.9
 	github.com/vmihailenco/msgpack/v5 v5.3.5
 	github.com/zieckey/goini v0.0.0-20180118150432-0da17d361d26
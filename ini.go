@@ -1,12 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/zieckey/goini"
 )
 
 type INIFormat struct {
+	KeySeparator string // written between keys and values
+	Quote        string // "never", "auto" or "always"
 }
 
 func (f *INIFormat) GetExtensions() []string {
@@ -18,17 +26,30 @@ func (f *INIFormat) GetExtensions() []string {
 func (f *INIFormat) GetFeatures() FormatFeatures {
 	return FormatFeatures{
 		Can_input:       true,
-		Can_output:      false, // TODO
-		Can_prettyprint: false,
+		Can_output:      true,
+		Can_prettyprint: true, // blank lines between sections
 		Can_scalar:      false,
 		Can_array:       false,
 		Can_object:      true,
+		Can_multidoc:    false,
 		Is_binary:       false,
 		Arbitrary_tree:  false,
 		Universal:       true,
 	}
 }
 
+func (f *INIFormat) AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.KeySeparator, "ini-separator", f.KeySeparator, "ini output: separator between keys and values")
+	fs.Func("ini-quote", "ini output: when to put values in double quotes: never, auto (when needed), always (default never)", func(s string) error {
+		switch s {
+		case "never", "auto", "always":
+			f.Quote = s
+			return nil
+		}
+		return fmt.Errorf("expected never, auto or always")
+	})
+}
+
 func (f *INIFormat) Input(b []byte) (any, error) {
 	ini := goini.New()
 	ini.SetParseSection(true)
@@ -46,12 +67,312 @@ func (f *INIFormat) Input(b []byte) (any, error) {
 		section := map[string]any{}
 		rv[sectionkey] = section
 		for key, value := range kvmap {
-			section[key] = value
+			section[key] = ini_unquote(value)
 		}
 	}
 	return rv, err
 }
 
-func (f *INIFormat) Output(a any, _ bool) ([]byte, error) {
-	return nil, fmt.Errorf("INIFormat.Output not implemented")
+// Undoes what format_value does with --ini-quote: a value in double quotes
+// loses them, and its backslash escapes.  Anything else is left alone.
+func ini_unquote(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+	b := strings.Builder{}
+	for i := 1; i < len(value)-1; i++ {
+		c := value[i]
+		if c == '"' {
+			return value // a quote in the middle, so it's not one quoted string
+		}
+		if c == '\\' && i+1 < len(value)-1 {
+			i++
+			switch c = value[i]; c {
+			case 'n':
+				c = '\n'
+			case '\\', '"':
+			default:
+				b.WriteByte('\\')
+			}
+		} else if c == '\\' {
+			return value // the closing quote is escaped
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func (f *INIFormat) Output(a any, prettyprint bool) ([]byte, error) {
+	// only supports an object of objects.  scalars at the top level go into
+	// the global section, which is written first, without a [header].  this
+	// is also where the "" section goes, which is what Input puts them in.
+	global, sections, err := ini_split(a)
+	if err != nil {
+		return nil, err
+	}
+
+	b := bytes.NewBuffer([]byte{})
+	if err := f.write_section(b, "", global); err != nil {
+		return nil, err
+	}
+	sectionnames := make([]string, 0, len(sections))
+	for name := range sections {
+		sectionnames = append(sectionnames, name)
+	}
+	sort.Strings(sectionnames)
+	for _, name := range sectionnames {
+		if prettyprint && b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		if strings.ContainsAny(name, "[]\n") {
+			return nil, fmt.Errorf("ini cannot represent the section name %q", name)
+		}
+		fmt.Fprintf(b, "[%s]\n", name)
+		if err := f.write_section(b, name, sections[name]); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// Sorts the top level of a value into the global section and the others.
+func ini_split(a any) (map[string]any, map[string]map[string]any, error) {
+	top, ok := a.(map[string]any)
+	if !ok {
+		return nil, nil, fmt.Errorf("ini output only supports objects at the top level")
+	}
+	global := map[string]any{}
+	sections := map[string]map[string]any{}
+	for key, value := range top {
+		if section, ok := value.(map[string]any); ok {
+			if key == goini.DefaultSection {
+				for k, v := range section {
+					global[k] = v
+				}
+			} else {
+				sections[key] = section
+			}
+		} else if _, ok := value.([]any); ok {
+			return nil, nil, fmt.Errorf("ini cannot represent the array at %q; only sections and scalar values are supported", key)
+		} else {
+			global[key] = value
+		}
+	}
+
+	return global, sections, nil
+}
+
+func (f *INIFormat) Colorize(b []byte, c *Colors) []byte {
+	w := bytes.NewBuffer(make([]byte, 0, 2*len(b)))
+	sep := []byte(strings.TrimSpace(f.KeySeparator))
+	if len(sep) == 0 {
+		sep = []byte("=")
+	}
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		body := bytes.TrimRight(line, "\r\n")
+		eol := line[len(body):]
+		lead := len(body) - len(bytes.TrimLeft(body, " \t"))
+		text := bytes.TrimRight(body[lead:], " \t")
+		trailing := body[lead+len(text):]
+		w.Write(body[:lead])
+		switch {
+		case len(text) == 0:
+		case text[0] == ';' || text[0] == '#':
+			c.paint(w, c.Null, text)
+		case text[0] == '[' && text[len(text)-1] == ']':
+			c.paint(w, c.Object, text[:1])
+			c.paint(w, c.Key, text[1:len(text)-1])
+			c.paint(w, c.Object, text[len(text)-1:])
+		case bytes.Contains(text, sep):
+			i := bytes.Index(text, sep)
+			key := bytes.TrimRight(text[:i], " \t")
+			c.paint(w, c.Key, key)
+			w.Write(text[len(key):i])
+			c.paint(w, c.Object, sep)
+			value := text[i+len(sep):]
+			trimmed := bytes.TrimLeft(value, " \t")
+			w.Write(value[:len(value)-len(trimmed)])
+			if len(trimmed) > 0 && trimmed[0] == '"' {
+				c.paint(w, c.String, trimmed)
+			} else {
+				c.paint(w, c.scalar(trimmed), trimmed)
+			}
+		default:
+			w.Write(text)
+		}
+		w.Write(trailing)
+		w.Write(eol)
+	}
+	return w.Bytes()
+}
+
+func (f *INIFormat) Patch(orig []byte, a any, prettyprint bool) ([]byte, error) {
+	global, sections, err := ini_split(a)
+	if err != nil {
+		return nil, err
+	}
+
+	// walk through the lines the same way goini does, rewriting or removing
+	// the values which changed
+	type iniBlock struct {
+		insertAt int
+		seen     map[string]bool
+	}
+	blocks := map[string]*iniBlock{"": {insertAt: 0, seen: map[string]bool{}}}
+	block := blocks[""]
+	section := global
+	edits := []textEdit{}
+	for pos := 0; pos < len(orig); {
+		start := pos
+		end := line_end(orig, pos)
+		pos = end
+		line := bytes.TrimSpace(orig[start:end])
+		if len(line) == 0 || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			name := string(line[1 : len(line)-1])
+			section = sections[name]
+			if section == nil {
+				edits = append(edits, textEdit{skip_back(orig, start, ""), end, ""})
+			}
+			block = &iniBlock{insertAt: end, seen: map[string]bool{}}
+			blocks[name] = block
+			continue
+		}
+		eq := bytes.IndexByte(orig[start:end], '=')
+		if eq < 0 {
+			continue
+		}
+		eq += start
+		key := string(bytes.TrimSpace(orig[start:eq]))
+		value, ok := section[key]
+		if !ok {
+			edits = append(edits, textEdit{start, end, ""})
+			continue
+		}
+		block.seen[key] = true
+		block.insertAt = end
+		valstart := eq + 1
+		for valstart < end && (orig[valstart] == ' ' || orig[valstart] == '\t') {
+			valstart++
+		}
+		valend := end
+		for valend > valstart && strings.ContainsRune(" \t\r\n", rune(orig[valend-1])) {
+			valend--
+		}
+		text, err := f.format_value(value)
+		if err != nil {
+			return nil, fmt.Errorf("ini cannot represent the value at %q: %w", key, err)
+		}
+		// compare values rather than text, so quoting which Input took off
+		// isn't taken off here too
+		if old := string(orig[valstart:valend]); text != old && ini_unquote(text) != ini_unquote(old) {
+			edits = append(edits, textEdit{valstart, valend, text})
+		}
+	}
+
+	// then add what's new
+	add := func(name string, section map[string]any, block *iniBlock) error {
+		b := bytes.NewBuffer([]byte{})
+		unseen := map[string]any{}
+		for key, value := range section {
+			if !block.seen[key] {
+				unseen[key] = value
+			}
+		}
+		if err := f.write_section(b, name, unseen); err != nil {
+			return err
+		}
+		edits = append(edits, textEdit{block.insertAt, block.insertAt, b.String()})
+		return nil
+	}
+	if err := add("", global, blocks[""]); err != nil {
+		return nil, err
+	}
+	sectionnames := []string{}
+	for name := range sections {
+		sectionnames = append(sectionnames, name)
+	}
+	sort.Strings(sectionnames)
+	for _, name := range sectionnames {
+		if block, ok := blocks[name]; ok {
+			if err := add(name, sections[name], block); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		b := bytes.NewBuffer([]byte{})
+		if prettyprint && len(orig) > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(b, "[%s]\n", name)
+		if err := f.write_section(b, name, sections[name]); err != nil {
+			return nil, err
+		}
+		edits = append(edits, textEdit{len(orig), len(orig), b.String()})
+	}
+	return apply_edits(orig, edits), nil
+}
+
+func (f *INIFormat) write_section(b *bytes.Buffer, name string, section map[string]any) error {
+	keys := make([]string, 0, len(section))
+	for key := range section {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		path := key
+		if name != "" {
+			path = name + "." + key
+		}
+		if key == "" || strings.ContainsAny(key, "=\n") || strings.HasPrefix(key, "[") || strings.HasPrefix(key, ";") || strings.HasPrefix(key, "#") {
+			return fmt.Errorf("ini cannot represent the key %q", path)
+		}
+		value, err := f.format_value(section[key])
+		if err != nil {
+			return fmt.Errorf("ini cannot represent the value at %q: %w", path, err)
+		}
+		fmt.Fprintf(b, "%s%s%s\n", key, f.KeySeparator, value)
+	}
+	return nil
+}
+
+func (f *INIFormat) format_value(value any) (string, error) {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		s = ""
+	case string:
+		s = v
+	case bool:
+		s = strconv.FormatBool(v)
+	case int:
+		s = strconv.Itoa(v)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case *big.Int:
+		s = v.String()
+	case []any:
+		return "", fmt.Errorf("arrays are not supported")
+	case map[string]any:
+		return "", fmt.Errorf("nested objects are not supported")
+	default:
+		s = fmt.Sprintf("%v", v)
+	}
+
+	quote := f.Quote == "always"
+	if f.Quote == "auto" {
+		quote = s != strings.TrimSpace(s) || strings.ContainsAny(s, "\"\\;#\n")
+	}
+	if quote {
+		s = strings.ReplaceAll(s, "\\", "\\\\")
+		s = strings.ReplaceAll(s, "\"", "\\\"")
+		s = strings.ReplaceAll(s, "\n", "\\n")
+		return "\"" + s + "\"", nil
+	}
+	if strings.Contains(s, "\n") {
+		return "", fmt.Errorf("multi-line strings need --ini-quote")
+	}
+	return s, nil
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	apex_log "github.com/apex/log"
+	"github.com/itchyny/gojq"
+)
+
+// One input file, and the format it will be decoded with.
+type inputFile struct {
+	filename string // "-" means stdin
+	fmtname  string
+	format   Format
+}
+
+// Reads and decodes the input files one at a time.  Files in a StreamFormat
+// produce one value per document; everything else produces one value per
+// file.  Besides driving App.Run, this is what gojq's input and inputs
+// builtins pull from, so an expression can consume the following inputs
+// itself.
+//
+// Decoding errors are returned as values, the same way gojq does it.
+type inputIter struct {
+	files []inputFile
+	index int
+	raw   io.Writer // if set, the raw input gets copied here as it is read
+	log   *apex_log.Entry
+
+	// the stream currently being decoded, if any
+	file   inputFile
+	reader io.ReadCloser
+	dec    DocumentDecoder
+}
+
+func (it *inputIter) Next() (any, bool) {
+	for {
+		if it.dec != nil {
+			value, err := it.dec.Decode()
+			if err == io.EOF {
+				it.close()
+				continue
+			}
+			if err != nil {
+				it.close()
+				return fmt.Errorf("could not decode %s as %s: %w", it.file.filename, it.file.fmtname, err), true
+			}
+			return normalize(value), true
+		}
+
+		if it.index >= len(it.files) {
+			return nil, false
+		}
+		file := it.files[it.index]
+		it.index++
+
+		reader, err := it.open(file)
+		if err != nil {
+			return err, true
+		}
+		if file.fmtname == "auto" {
+			// look at what's there so far, without waiting for more
+			buffered := bufio.NewReaderSize(reader, 64*1024)
+			buffered.Peek(1)
+			head, _ := buffered.Peek(buffered.Buffered())
+			file.fmtname = detect_fmt_by_content(head)
+			file.format = formats[file.fmtname]
+			it.files[it.index-1] = file
+			it.log.Debugf("%s looks like %s", file.filename, file.fmtname)
+			reader = struct {
+				io.Reader
+				io.Closer
+			}{buffered, reader}
+		}
+		if stream, ok := file.format.(StreamFormat); ok {
+			it.file = file
+			it.reader = reader
+			it.dec = stream.NewDecoder(bufio.NewReader(reader))
+			continue
+		}
+		value, err := file.read(reader)
+		reader.Close()
+		if err != nil {
+			return err, true
+		}
+		return value, true
+	}
+}
+
+// Starts over with a different set of files.
+func (it *inputIter) reset(files []inputFile) {
+	if it.dec != nil {
+		it.close()
+	}
+	it.files = files
+	it.index = 0
+}
+
+func (it *inputIter) open(file inputFile) (io.ReadCloser, error) {
+	reader, err := file.open()
+	if err != nil || it.raw == nil {
+		return reader, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(reader, it.raw), reader}, nil
+}
+
+func (it *inputIter) close() {
+	it.reader.Close()
+	it.reader = nil
+	it.dec = nil
+}
+
+// Reads all of the inputs from another iterator, and returns them as a single
+// array.  This is what --slurp does.
+type slurpIter struct {
+	inner gojq.Iter
+	done  bool
+}
+
+func (it *slurpIter) Next() (any, bool) {
+	if it.done {
+		return nil, false
+	}
+	it.done = true
+	values := []any{}
+	for {
+		value, ok := it.inner.Next()
+		if !ok {
+			break
+		}
+		if err, ok := value.(error); ok {
+			return err, true
+		}
+		values = append(values, value)
+	}
+	return values, true
+}
+
+// Produces a single null, for -n.
+type nullIter struct {
+	done bool
+}
+
+func (it *nullIter) Next() (any, bool) {
+	if it.done {
+		return nil, false
+	}
+	it.done = true
+	return nil, true
+}
+
+func (f inputFile) open() (io.ReadCloser, error) {
+	if f.filename == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	reader, err := os.Open(f.filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read input file %s: %w", f.filename, err)
+	}
+	return reader, nil
+}
+
+func (f inputFile) read(reader io.Reader) (any, error) {
+	rawinput, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not read input file %s: %w", f.filename, err)
+	}
+	value, err := f.format.Input(rawinput)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode %s as %s: %w", f.filename, f.fmtname, err)
+	}
+	return normalize(value), nil
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 )
 
 type JSONFormat struct {
@@ -23,6 +25,7 @@ func (f *JSONFormat) GetFeatures() FormatFeatures {
 		Can_scalar:      true,
 		Can_array:       true,
 		Can_object:      true,
+		Can_multidoc:    true,
 		Is_binary:       false,
 		Arbitrary_tree:  true,
 		Universal:       true,
@@ -30,9 +33,18 @@ func (f *JSONFormat) GetFeatures() FormatFeatures {
 }
 
 func (f *JSONFormat) Input(b []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
 	var data any
-	err := json.Unmarshal(b, &data)
-	return data, err
+	if err := dec.Decode(&data); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the top-level value")
+	}
+	return data, nil
 }
 
 func (f *JSONFormat) Output(a any, prettyprint bool) ([]byte, error) {
@@ -44,3 +56,67 @@ func (f *JSONFormat) Output(a any, prettyprint bool) ([]byte, error) {
 	err := e.Encode(a)
 	return b.Bytes(), err
 }
+
+func (f *JSONFormat) NewDecoder(r io.Reader) DocumentDecoder {
+	// handles NDJSON as well as any other concatenation of json values
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return decoderFunc(func() (any, error) {
+		var data any
+		err := dec.Decode(&data)
+		return data, err
+	})
+}
+
+func (f *JSONFormat) Colorize(b []byte, c *Colors) []byte {
+	w := bytes.NewBuffer(make([]byte, 0, 2*len(b)))
+	containers := []string{} // colors of the arrays/objects we're inside
+	for i := 0; i < len(b); {
+		switch ch := b[i]; ch {
+		case ' ', '\t', '\r', '\n':
+			w.WriteByte(ch)
+			i++
+		case '"':
+			n := quoted_len(b[i:], `"`, true)
+			sgr := c.String
+			if rest := bytes.TrimLeft(b[i+n:], " \t\r\n"); len(rest) > 0 && rest[0] == ':' {
+				sgr = c.Key
+			}
+			c.paint(w, sgr, b[i:i+n])
+			i += n
+		case '[', '{':
+			sgr := c.Array
+			if ch == '{' {
+				sgr = c.Object
+			}
+			containers = append(containers, sgr)
+			c.paint(w, sgr, b[i:i+1])
+			i++
+		case ']', '}':
+			sgr := c.Array
+			if ch == '}' {
+				sgr = c.Object
+			}
+			if len(containers) > 0 {
+				containers = containers[:len(containers)-1]
+			}
+			c.paint(w, sgr, b[i:i+1])
+			i++
+		case ',', ':':
+			sgr := c.Object
+			if len(containers) > 0 {
+				sgr = containers[len(containers)-1]
+			}
+			c.paint(w, sgr, b[i:i+1])
+			i++
+		default:
+			n := bytes.IndexAny(b[i:], " \t\r\n\",:[]{}")
+			if n < 0 {
+				n = len(b) - i
+			}
+			c.paint(w, c.scalar(b[i:i+n]), b[i:i+n])
+			i += n
+		}
+	}
+	return w.Bytes()
+}
@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
-	"io/fs"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
@@ -25,6 +25,7 @@ type FormatFeatures struct {
 	Can_scalar      bool // supports a scalar value (string/int/bool/float/null) at the top level
 	Can_array       bool // supports array (slice/list) at the top level
 	Can_object      bool // supports object (struct/dict/map) at the top level
+	Can_multidoc    bool // supports several top-level documents in one stream
 	Is_binary       bool // binary formats cannot be safely printed to a terminal
 	Arbitrary_tree  bool // can represent as deep a hierarchy as you like
 	Universal       bool // data is converted in a standardized/universal way
@@ -37,33 +38,105 @@ type Format interface {
 	Output(a any, pretty bool) ([]byte, error)
 }
 
+// Formats with their own command line options implement this, and register
+// them here.  Option names should start with the format name.
+type FlaggedFormat interface {
+	AddFlags(fs *flag.FlagSet)
+}
+
+// Multidoc formats can also implement this, so their documents get decoded one
+// at a time as they are read, rather than all at once.
+type StreamFormat interface {
+	NewDecoder(r io.Reader) DocumentDecoder
+}
+
+// Returns the next document each time it is called, and io.EOF when there are
+// no more.
+type DocumentDecoder interface {
+	Decode() (any, error)
+}
+
+// Lets a plain function be used as a DocumentDecoder.
+type decoderFunc func() (any, error)
+
+func (f decoderFunc) Decode() (any, error) {
+	return f()
+}
+
+// Multidoc formats which need something written between consecutive top-level
+// documents (like yaml's "---") implement this as well.
+type DocumentSeparator interface {
+	Separator() []byte
+}
+
+// Formats which can rewrite an existing document implement this.  orig is the
+// raw input, and a is the new value.  Only the parts of orig which differ from
+// a get rewritten, so comments, key order and layout survive.
+type PreservingFormat interface {
+	Patch(orig []byte, a any, pretty bool) ([]byte, error)
+}
+
+// Formats which can hold some of the values which normalize turns into strings
+// or tagged objects (like dates, binary data or ObjectIDs) implement this, so
+// denormalize turns them back before Output.
+type NativeFormat interface {
+	NativeTypes() NativeTypes
+}
+
+// Text formats which can highlight their own output for a terminal implement
+// this.  b is what Output or Patch returned.
+type ColorFormat interface {
+	Colorize(b []byte, c *Colors) []byte
+}
+
 var formats = map[string]Format{
 	// all keys in lower case
 	// format args are passed through ToLower() before looking them up here
-	"bson":    &BSONFormat{},
-	"csv":     &CSVFormat{},
-	"ini":     &INIFormat{},
-	"json":    &JSONFormat{},
-	"msgpack": &MsgPackFormat{},
-	"toml":    &TOMLFormat{},
-	"xml":     &XMLFormat{},
-	"yaml":    &YAMLFormat{},
+	"bson":          &BSONFormat{},
+	"csv":           csv_format,
+	"ejson":         &EJSONFormat{Canonical: true},
+	"ejson-relaxed": &EJSONFormat{Canonical: false},
+	"ini":           &INIFormat{KeySeparator: " = ", Quote: "never"},
+	"json":          &JSONFormat{},
+	"msgpack":       &MsgPackFormat{Timestamps: "rfc3339", Bytes: "bin"},
+	"toml":          &TOMLFormat{},
+	"tsv":           &TSVFormat{csv_format},
+	"xml":           &XMLFormat{Namespaces: "none", Convention: "default", Root: "root", Item: "element"},
+	"yaml":          &YAMLFormat{},
 }
 
 type App struct {
 	log *apex_log.Entry
 
 	infmtname  string
+	outfmtreq  string // as requested; "auto" means the same as the input
 	outfmtname string
 
 	prettyprint bool
+	collect     bool
+	preserve    bool
+	raw         bool    // write string results as they are, not in the output format
+	raw_end     string  // written after each result in raw mode
+	nullinput   bool    // run the expression once on null, rather than on each input
+	exitstatus  bool    // set the exit code from the last result
+	colors      *Colors // nil means no colors
+
+	nresults   int // results from the expression so far
+	lastresult any
 
-	input_filename  string
+	inputs          gojq.Iter
+	input_files     []inputFile
+	input_iter      *inputIter
+	rawinput        *bytes.Buffer // only kept in preserving mode
+	inplace         bool
+	backup_suffix   string
+	forcebinout     bool
 	output_filename string
 
-	expr *gojq.Code
+	expr      *gojq.Code
+	varnames  []string // jq variables from the command line, like $ARGS
+	varvalues []any
 
-	infmt  Format
 	outfmt Format
 }
 
@@ -100,7 +173,7 @@ func (a *App) detect_fmt_by_fn(fn string) string {
 
 func (a *App) list_formats() {
 	// inspired by `ffmpeg -codecs`
-	order := "POISAsoaB"
+	order := "POISAsoaMB"
 	type flagdesc struct {
 		test func(f FormatFeatures) bool
 		desc string
@@ -114,6 +187,7 @@ func (a *App) list_formats() {
 		's': {desc: "Supports a scalar value (string/int/float/bool/null) at the top level", test: func(f FormatFeatures) bool { return f.Can_scalar }},
 		'o': {desc: "Supports object (struct/dict/map) at the top level", test: func(f FormatFeatures) bool { return f.Can_object }},
 		'a': {desc: "Supports array (list/slice) at the top level", test: func(f FormatFeatures) bool { return f.Can_array }},
+		'M': {desc: "Supports multiple documents in one stream", test: func(f FormatFeatures) bool { return f.Can_multidoc }},
 		'B': {desc: "Binary format (cannot safely write to stdout)", test: func(f FormatFeatures) bool { return f.Is_binary }},
 	}
 	format_names := []string{}
@@ -151,6 +225,10 @@ func (a *App) list_formats() {
 		for _, ext := range format.GetExtensions() {
 			extensionslist = append(extensionslist, fmt.Sprintf(".%s", ext))
 		}
+		if len(extensionslist) == 0 {
+			a.log.Infof("%s  %s has no file extensions", flagstr, fmtname)
+			continue
+		}
 		extensionstr := strings.Join(extensionslist, ", ")
 		a.log.Infof("%s  %s has file extensions %s", flagstr, fmtname, extensionstr)
 	}
@@ -170,8 +248,53 @@ func NewApp() *App {
 	outfnarg := flag.String("o", "-", "output filename")
 	formatsarg := flag.Bool("formats", false, "list all supported formats")
 	prettyprintarg := flag.Bool("pretty-print", true, "pretty-print formats which support it")
+	slurparg := flag.Bool("slurp", false, "read all inputs into one array, and run the expression once on that")
+	collectarg := flag.Bool("collect", false, "collect all results into one array, for output formats which only hold one document")
+	preservearg := flag.Bool("preserve", false, "keep the comments, key order and layout of the input file, rewriting only what the expression changed")
+	inplacearg := flag.Bool("i", false, "edit the input files in place")
+	flag.BoolVar(inplacearg, "in-place", false, "edit the input files in place")
+	backuparg := flag.String("backup", "", "when editing in place, keep the original files with this suffix added (like .bak)")
 	forcebinoutarg := flag.Bool("force-binary-output", false, "force writing to stdout if output format is binary")
-	flag.Parse()
+	rawarg := flag.Bool("r", false, "write string results as they are, without quotes, rather than in the output format")
+	flag.BoolVar(rawarg, "raw-output", false, "write string results as they are, without quotes, rather than in the output format")
+	joinarg := flag.Bool("j", false, "like -r, but without a newline after each result")
+	flag.BoolVar(joinarg, "join-output", false, "like -r, but without a newline after each result")
+	raw0arg := flag.Bool("raw-output0", false, "like -r, but with a NUL after each result instead of a newline")
+	nullinputarg := flag.Bool("n", false, "run the expression once with null as its input; the inputs are still there for input and inputs")
+	flag.BoolVar(nullinputarg, "null-input", false, "run the expression once with null as its input; the inputs are still there for input and inputs")
+	colorarg := flag.Bool("C", false, "colorize the output, even when it isn't going to a terminal")
+	flag.BoolVar(colorarg, "color-output", false, "colorize the output, even when it isn't going to a terminal")
+	monoarg := flag.Bool("M", false, "don't colorize the output")
+	flag.BoolVar(monoarg, "monochrome-output", false, "don't colorize the output")
+	exitstatusarg := flag.Bool("e", false, "exit with 1 if the last result is false or null, or 4 if there were no results")
+	flag.BoolVar(exitstatusarg, "exit-status", false, "exit with 1 if the last result is false or null, or 4 if there were no results")
+	module_paths := []string{}
+	flag.Func("L", "search this directory for jq modules (can be given more than once; replaces the default ~/.jq, $ORIGIN/../lib/jq and $ORIGIN/../lib)", func(dir string) error {
+		module_paths = append(module_paths, dir)
+		return nil
+	})
+	format_names := []string{}
+	for fmtname := range formats {
+		format_names = append(format_names, fmtname)
+	}
+	sort.Strings(format_names)
+	for _, fmtname := range format_names {
+		if flagged, ok := formats[fmtname].(FlaggedFormat); ok {
+			flagged.AddFlags(flag.CommandLine)
+		}
+	}
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] expression [files...]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), jq_args_usage)
+	}
+	cmd, err := split_cmdline(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Error(err.Error())
+		flag.Usage()
+		os.Exit(2)
+	}
+	flag.CommandLine.Parse(cmd.flags)
 
 	if *formatsarg {
 		a := &App{log: log}
@@ -179,130 +302,347 @@ func NewApp() *App {
 	}
 
 	// gojq expression
-	if len(flag.Args()) < 1 {
+	if cmd.expression == "" {
 		log.Error("A 'jq' expression is required as the first positional argument.")
 		flag.Usage()
 		os.Exit(1)
 	}
-	exprstr := flag.Arg(0)
-	parsed, err := gojq.Parse(exprstr)
+	parsed, err := gojq.Parse(cmd.expression)
 	if err != nil {
 		log.Fatalf("Could not parse jq expression: %v", err)
 	}
-	compiled, err := gojq.Compile(parsed)
-	if err != nil {
-		log.Fatalf("Could not compile jq expression: %v", err)
-	}
 
-	// figure out the input filename
-
-	infn := "-"
-	if len(flag.Args()) > 2 {
-		log.Fatal("At most one input file may be specified.")
-	} else if len(flag.Args()) == 2 {
-		infn = flag.Arg(1)
+	// figure out the input filenames
+	infns := cmd.files
+	if len(infns) == 0 {
+		infns = []string{"-"}
 	}
 	outfn := *outfnarg
 
 	a := &App{
 		infmtname:       strings.ToLower(*infmtarg),
-		outfmtname:      strings.ToLower(*outfmtarg),
-		input_filename:  infn,
+		outfmtreq:       strings.ToLower(*outfmtarg),
 		output_filename: outfn,
 		prettyprint:     *prettyprintarg,
-		expr:            compiled,
+		collect:         *collectarg,
+		preserve:        *preservearg,
+		inplace:         *inplacearg,
+		backup_suffix:   *backuparg,
+		forcebinout:     *forcebinoutarg,
+		nullinput:       *nullinputarg,
+		exitstatus:      *exitstatusarg,
 		log:             log,
 	}
+	switch {
+	case *raw0arg:
+		a.raw, a.raw_end = true, "\x00"
+	case *joinarg:
+		a.raw, a.raw_end = true, ""
+	case *rawarg:
+		a.raw, a.raw_end = true, "\n"
+	}
 
-	// figure out the input file type if "auto"
-	if a.infmtname == "auto" {
-		a.infmtname = a.detect_fmt_by_fn(a.input_filename)
+	// colors are on by default for terminals; see https://no-color.org
+	usecolor := *colorarg || (os.Getenv("NO_COLOR") == "" && outfn == "-" && isatty.IsTerminal(os.Stdout.Fd()))
+	if usecolor && !*monoarg && !a.inplace {
+		colors, err := parse_colors(os.Getenv("ANYQ_COLORS"))
+		if err != nil {
+			a.log.WithError(err).Warn("could not use $ANYQ_COLORS")
+		}
+		a.colors = &colors
 	}
-	if a.infmtname == "auto" {
-		a.infmtname = detect_fmt_by_exename()
+
+	if a.inplace {
+		for _, infn := range infns {
+			if infn == "-" {
+				a.log.Fatal("Can't edit stdin in place.  Please give an input filename, or leave out -i.")
+			}
+		}
+		if outfn != "-" {
+			a.log.Fatal("-i and -o can't be used together.")
+		}
+		if *slurparg {
+			a.log.Fatal("-i can't be combined with --slurp.")
+		}
+		if a.nullinput {
+			a.log.Fatal("-i can't be combined with -n.")
+		}
+	} else if a.backup_suffix != "" {
+		a.log.Fatal("--backup only makes sense with -i.")
 	}
-	if a.infmtname == "auto" {
-		a.log.Fatal("Unable to determine input file format.  Please provide an --input-format= parameter.")
+
+	// figure out each input file's type if "auto"
+	for _, infn := range infns {
+		a.input_files = append(a.input_files, a.new_input_file(infn, a.infmtname))
 	}
-	if _, ok := formats[a.infmtname]; !ok {
-		a.log.Fatalf("I don't know how to speak the '%s' format.  See --formats for a list.", a.infmtname)
+	a.input_iter = &inputIter{files: a.input_files, log: log}
+	if a.preserve {
+		a.rawinput = bytes.NewBuffer([]byte{})
+		a.input_iter.raw = a.rawinput
 	}
-	a.infmt = formats[a.infmtname]
-	if features := a.infmt.GetFeatures(); !features.Can_input {
-		a.log.Fatalf("The '%s' format doesn't know how to handle input.", a.infmtname)
+	a.inputs = a.input_iter
+	if *slurparg {
+		a.inputs = &slurpIter{inner: a.inputs}
 	}
 
-	// figure out the output file type if "auto"
-	if a.outfmtname == "auto" {
-		a.outfmtname = a.detect_fmt_by_fn(a.output_filename)
+	a.setup_variables(cmd)
+
+	compiled, err := gojq.Compile(parsed,
+		gojq.WithInputIter(a.inputs),
+		gojq.WithVariables(a.varnames),
+		gojq.WithEnvironLoader(os.Environ),
+		gojq.WithModuleLoader(new_module_loader(a, module_paths)),
+	)
+	if err != nil {
+		log.Fatalf("Could not compile jq expression: %v", err)
 	}
-	if a.outfmtname == "auto" {
-		a.outfmtname = detect_fmt_by_exename()
+	a.expr = compiled
+
+	if a.preserve && ((len(a.input_files) != 1 && !a.inplace) || *slurparg || a.collect || a.nullinput) {
+		a.log.Fatal("--preserve needs exactly one input file (or -i), and can't be combined with --slurp, --collect or -n.")
 	}
-	if a.outfmtname == "auto" {
-		a.outfmtname = a.infmtname
+
+	// figure out the output file type if "auto"
+	if a.outfmtreq == "auto" && !a.inplace {
+		a.outfmtreq = a.detect_fmt_by_fn(a.output_filename)
+		if a.outfmtreq == "auto" {
+			a.outfmtreq = detect_fmt_by_exename()
+		}
 	}
-	if _, ok := formats[a.outfmtname]; !ok {
-		a.log.Fatalf("I don't know how to speak the '%s' format.  See --formats for a list.", a.outfmtname)
+	if a.nullinput && a.outfmtreq == "auto" && a.input_files[0].fmtname == "auto" {
+		// the input might never be read, so don't wait for it
+		a.outfmtreq = "json"
 	}
-	a.outfmt = formats[a.outfmtname]
-	outfeatures := a.outfmt.GetFeatures()
-	if !outfeatures.Can_output {
-		a.log.Fatalf("The '%s' format doesn't know how to handle output.  Try passing something else with --output-format= parameter.", a.outfmtname)
+	// check it now if possible; otherwise it waits until the input is read
+	checkfiles := a.input_files[:1]
+	if a.inplace {
+		// each file keeps its own format, unless told otherwise
+		checkfiles = a.input_files
 	}
-	if outfn == "-" && outfeatures.Is_binary && !*forcebinoutarg && isatty.IsTerminal(os.Stdout.Fd()) {
-		a.log.Fatalf("Preventing binary (%s) output to terminal.  Use --force-binary-output if you're sure you want that.", a.outfmtname)
+	for _, file := range checkfiles {
+		if a.outfmtreq != "auto" || file.fmtname != "auto" {
+			a.use_output_format(file)
+		}
 	}
 
 	return a
 }
 
+// Picks the format for an input file.  If the requested format is "auto", it
+// comes from the filename, or the executable name, or else it is left as
+// "auto" to be sorted out once the file is opened; see detect_fmt_by_content.
+func (a *App) new_input_file(fn string, fmtname string) inputFile {
+	if fmtname == "auto" {
+		fmtname = a.detect_fmt_by_fn(fn)
+	}
+	if fmtname == "auto" {
+		fmtname = detect_fmt_by_exename()
+	}
+	if fmtname == "auto" {
+		return inputFile{filename: fn, fmtname: fmtname}
+	}
+	if _, ok := formats[fmtname]; !ok {
+		a.log.Fatalf("I don't know how to speak the '%s' format.  See --formats for a list.", fmtname)
+	}
+	format := formats[fmtname]
+	if features := format.GetFeatures(); !features.Can_input {
+		a.log.Fatalf("The '%s' format doesn't know how to handle input.", fmtname)
+	}
+	return inputFile{filename: fn, fmtname: fmtname, format: format}
+}
+
+// Sets up the output format for results computed from the given input file.
+// If no output format was picked explicitly, it's the same as the input.
+func (a *App) use_output_format(infile inputFile) {
+	outfmtname := a.outfmtreq
+	if outfmtname == "auto" {
+		outfmtname = infile.fmtname
+	}
+	if _, ok := formats[outfmtname]; !ok {
+		a.log.Fatalf("I don't know how to speak the '%s' format.  See --formats for a list.", outfmtname)
+	}
+	outfmt := formats[outfmtname]
+	if !outfmt.GetFeatures().Can_output {
+		a.log.Fatalf("The '%s' format doesn't know how to handle output.  Try passing something else with --output-format= parameter.", outfmtname)
+	}
+	if a.preserve {
+		if _, ok := outfmt.(PreservingFormat); !ok {
+			a.log.Fatalf("The '%s' format doesn't support --preserve.", outfmtname)
+		}
+		if outfmtname != infile.fmtname {
+			a.log.Fatalf("--preserve can't convert between formats (%s → %s).", infile.fmtname, outfmtname)
+		}
+	}
+	if a.collect && !outfmt.GetFeatures().Can_array {
+		a.log.Fatalf("The '%s' format can't hold an array at the top level, so --collect can't gather the results into one.", outfmtname)
+	}
+	if !a.inplace && a.output_filename == "-" && outfmt.GetFeatures().Is_binary && !a.forcebinout && isatty.IsTerminal(os.Stdout.Fd()) {
+		a.log.Fatalf("Preventing binary (%s) output to terminal.  Use --force-binary-output if you're sure you want that.", outfmtname)
+	}
+	a.outfmtname = outfmtname
+	a.outfmt = outfmt
+}
+
 func (a *App) Run() {
-	// read input
-	var rawinput []byte
-	var err error
-	if a.input_filename == "-" {
-		buf := bytes.NewBuffer([]byte{})
-		_, err = buf.ReadFrom(os.Stdin)
-		rawinput = buf.Bytes()
-	} else {
-		rawinput, err = os.ReadFile(a.input_filename)
+	if a.inplace {
+		// run through the files one at a time, replacing each with its results
+		for _, file := range a.input_files {
+			a.input_iter.reset([]inputFile{file})
+			if a.rawinput != nil {
+				a.rawinput.Reset()
+			}
+			a.outfmt = nil
+			outbuf := bytes.NewBuffer([]byte{})
+			a.process(outbuf)
+			if err := replace_file(file.filename, outbuf.Bytes(), a.backup_suffix); err != nil {
+				a.log.WithError(err).Fatalf("could not replace file %s", file.filename)
+			}
+		}
+		return
 	}
-	if err != nil {
-		a.log.WithError(err).Fatalf("could not read input file %s", a.input_filename)
+
+	// write output as we go, if writing to stdout
+	if a.output_filename == "-" {
+		a.process(os.Stdout)
+		return
 	}
-	input, err := a.infmt.Input(rawinput)
-	if err != nil {
-		a.log.WithError(err).Fatalf("could not decode input as %s", a.infmtname)
+	outbuf := bytes.NewBuffer([]byte{})
+	a.process(outbuf)
+	if err := os.WriteFile(a.output_filename, outbuf.Bytes(), 0666); err != nil {
+		a.log.WithError(err).Fatalf("could not write file %s", a.output_filename)
 	}
-	// execute gojq things
-	outiter := a.expr.Run(input)
-	output, ok := outiter.Next()
-	if !ok {
-		a.log.Fatalf("gojq didn't return anything?")
+}
+
+// Runs the expression on everything from a.inputs, and writes the results.
+func (a *App) process(out io.Writer) {
+	// execute gojq things, once for each input
+	count := 0
+	docs := 0 // results written in the output format, rather than raw
+	collected := []any{}
+	ninputs := 0
+	inputs := a.inputs
+	if a.nullinput {
+		inputs = &nullIter{}
+	}
+	for {
+		input, ok := inputs.Next()
+		if !ok {
+			break
+		}
+		ninputs++
+		if err, ok := input.(error); ok {
+			a.log.WithError(err).Fatal("could not read input")
+		}
+		if a.outfmt == nil {
+			// now that the first input's format is known for sure
+			a.use_output_format(a.input_iter.files[0])
+		}
+		outiter := a.expr.Run(input, a.varvalues...)
+		for {
+			output, ok := outiter.Next()
+			if !ok {
+				break
+			}
+			if err, ok := output.(error); ok {
+				a.log.Infof("gojq returned an error; err is %v", err)
+				a.log.WithError(err).Fatal("unable to execute gojq expression")
+			}
+			// a.log.Infof("output: %#v", output)
+			count++
+			a.nresults++
+			if a.collect || a.preserve {
+				collected = append(collected, output)
+				continue
+			}
+			a.lastresult = output
+			if str, ok := output.(string); ok && a.raw {
+				a.emit_raw(out, str)
+				continue
+			}
+			if docs > 0 && !a.outfmt.GetFeatures().Can_multidoc {
+				a.log.Fatalf("The '%s' format can only hold one document, but the expression returned more than one result.  Use --collect to gather them into an array.", a.outfmtname)
+			}
+			a.emit(out, output, docs)
+			docs++
+		}
 	}
-	if err, ok := output.(error); ok {
-		a.log.Infof("gojq returned an error; err is %v", err)
-		a.log.WithError(err).Fatal("unable to execute gojq expression")
+	if a.outfmt == nil {
+		a.use_output_format(a.input_iter.files[0])
 	}
-	// a.log.Infof("output: %#v", output)
+	if a.preserve {
+		// the whole input has been read by now, so it can be patched
+		if ninputs != 1 || len(collected) != 1 {
+			a.log.Fatalf("--preserve needs exactly one input document and one result, but got %d and %d.", ninputs, len(collected))
+		}
+		a.lastresult = collected[0]
+		rawoutput, err := a.outfmt.(PreservingFormat).Patch(a.rawinput.Bytes(), collected[0], a.prettyprint)
+		if err != nil {
+			a.log.WithError(err).Fatalf("could not update the %s document", a.outfmtname)
+		}
+		rawoutput = a.colorize(rawoutput)
+		if _, err = out.Write(rawoutput); err != nil {
+			a.log.WithError(err).Fatalf("could not write file %s", a.output_filename)
+		}
+	} else if a.collect {
+		a.lastresult = collected
+		a.emit(out, collected, 0)
+	} else if count == 0 {
+		a.log.Debug("gojq didn't return anything")
+	}
+}
 
-	// write output
-	rawoutput, err := a.outfmt.Output(output, a.prettyprint)
+// Encode one result and write it out.  index is the number of results
+// written before this one, so separators can go in between them.
+func (a *App) emit(w io.Writer, output any, index int) {
+	rawoutput, err := a.outfmt.Output(denormalize(output, native_types(a.outfmt)), a.prettyprint)
 	if err != nil {
 		a.log.WithError(err).Fatalf("could not encode output as %s", a.outfmtname)
 	}
-	if a.output_filename == "-" {
-		_, err = os.Stdout.Write(rawoutput)
-	} else {
-		err = os.WriteFile(a.output_filename, rawoutput, fs.ModePerm)
+	rawoutput = a.colorize(rawoutput)
+	if sep, ok := a.outfmt.(DocumentSeparator); ok && index > 0 {
+		rawoutput = append(sep.Separator(), rawoutput...)
 	}
-	if err != nil {
+	if a.raw && !a.outfmt.GetFeatures().Is_binary {
+		// end it the same way as the raw strings around it
+		rawoutput = append(bytes.TrimSuffix(rawoutput, []byte("\n")), a.raw_end...)
+	}
+	if _, err = w.Write(rawoutput); err != nil {
 		a.log.WithError(err).Fatalf("could not write file %s", a.output_filename)
 	}
 }
 
+// Highlights encoded output, if colors are on and the format knows how.
+func (a *App) colorize(b []byte) []byte {
+	if colorer, ok := a.outfmt.(ColorFormat); ok && a.colors != nil {
+		return colorer.Colorize(b, a.colors)
+	}
+	return b
+}
+
+// Write a string result as it is, for -r and friends.
+func (a *App) emit_raw(w io.Writer, output string) {
+	if _, err := io.WriteString(w, output+a.raw_end); err != nil {
+		a.log.WithError(err).Fatalf("could not write file %s", a.output_filename)
+	}
+}
+
+// The exit code, which is always 0 unless -e was given.  Then it works like
+// jq's: 1 if the last result was false or null, 4 if there were no results.
+func (a *App) exit_code() int {
+	if !a.exitstatus {
+		return 0
+	}
+	if a.nresults == 0 {
+		return 4
+	}
+	if a.lastresult == nil || a.lastresult == false {
+		return 1
+	}
+	return 0
+}
+
 func main() {
 	a := NewApp()
 	a.Run()
+	os.Exit(a.exit_code())
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	apex_log "github.com/apex/log"
+	"github.com/itchyny/gojq"
+)
+
+// Where jq looks for modules, when no -L options are given.  ~/.jq is also
+// loaded automatically, if it's a file rather than a directory.
+var default_module_paths = []string{"~/.jq", "$ORIGIN/../lib/jq", "$ORIGIN/../lib"}
+
+// Finds modules for import and include.  jq modules are left to gojq's own
+// loader; data modules (import "name" as $name;) can be in any format that
+// anyq can read, picked by their file extension.
+type moduleLoader struct {
+	log   *apex_log.Entry
+	paths []string
+	jq    gojq.ModuleLoader
+}
+
+func new_module_loader(a *App, paths []string) *moduleLoader {
+	if len(paths) == 0 {
+		paths = default_module_paths
+	}
+	expanded := make([]string, len(paths))
+	for i, path := range paths {
+		expanded[i] = expand_module_path(path)
+	}
+	return &moduleLoader{
+		log:   a.log,
+		paths: expanded,
+		jq:    gojq.NewModuleLoader(expanded),
+	}
+}
+
+// Substitutes ~ and $ORIGIN (the directory anyq lives in) the way jq does.
+func expand_module_path(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[1:])
+		}
+	}
+	if path == "$ORIGIN" || strings.HasPrefix(path, "$ORIGIN/") {
+		if exe, err := os.Executable(); err == nil {
+			if exe, err := filepath.EvalSymlinks(exe); err == nil {
+				return filepath.Join(filepath.Dir(exe), strings.TrimPrefix(path, "$ORIGIN"))
+			}
+		}
+	}
+	return path
+}
+
+func (l *moduleLoader) LoadInitModules() ([]*gojq.Query, error) {
+	return l.jq.(interface {
+		LoadInitModules() ([]*gojq.Query, error)
+	}).LoadInitModules()
+}
+
+func (l *moduleLoader) LoadModuleWithMeta(name string, meta map[string]any) (*gojq.Query, error) {
+	return l.jq.(interface {
+		LoadModuleWithMeta(string, map[string]any) (*gojq.Query, error)
+	}).LoadModuleWithMeta(name, meta)
+}
+
+// Loads a data module, as an array of all of the documents in it, the same as
+// --slurpfile.
+func (l *moduleLoader) LoadJSONWithMeta(name string, meta map[string]any) (any, error) {
+	paths := l.paths
+	if search := module_search_path(meta); search != "" {
+		paths = append([]string{search}, paths...)
+	}
+
+	fmtnames := []string{}
+	for fmtname := range formats {
+		fmtnames = append(fmtnames, fmtname)
+	}
+	sort.Strings(fmtnames)
+
+	for _, base := range paths {
+		for _, fmtname := range fmtnames {
+			format := formats[fmtname]
+			if !format.GetFeatures().Can_input {
+				continue
+			}
+			for _, ext := range format.GetExtensions() {
+				candidates := []string{
+					filepath.Join(base, name+"."+ext),
+					filepath.Join(base, name, filepath.Base(name)+"."+ext),
+				}
+				for _, fn := range candidates {
+					if _, err := os.Stat(fn); err != nil {
+						continue
+					}
+					l.log.Debugf("loading data module %q from %s as %s", name, fn, fmtname)
+					file := inputFile{filename: fn, fmtname: fmtname, format: format}
+					value, _ := (&slurpIter{inner: &inputIter{files: []inputFile{file}, log: l.log}}).Next()
+					if err, ok := value.(error); ok {
+						return nil, err
+					}
+					return value, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("module not found: %q", name)
+}
+
+// Works out the "search" directory from an import's metadata, relative to
+// the module doing the importing if there is one.  This is the same thing
+// gojq does for jq modules.
+func module_search_path(meta map[string]any) string {
+	search, _ := meta["search"].(string)
+	if search == "" {
+		return ""
+	}
+	if filepath.IsAbs(search) {
+		return search
+	}
+	if strings.HasPrefix(search, "~") {
+		return expand_module_path(search)
+	}
+	if importer, _ := meta["$$path"].(string); importer != "" {
+		return filepath.Join(filepath.Dir(importer), search)
+	}
+	return search
+}
@@ -1,8 +1,21 @@
 package main
 
-import "github.com/vmihailenco/msgpack/v5"
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
 
 type MsgPackFormat struct {
+	Timestamps string // how to read timestamps: rfc3339, unix or date
+	Bytes      string // how to write binary data: bin or str
 }
 
 func (f *MsgPackFormat) GetExtensions() []string {
@@ -21,19 +34,163 @@ func (f *MsgPackFormat) GetFeatures() FormatFeatures {
 		Can_scalar:      true,
 		Can_array:       true,
 		Can_object:      true,
+		Can_multidoc:    true,
 		Is_binary:       true,
 		Arbitrary_tree:  true,
 		Universal:       true,
 	}
 }
 
+func (f *MsgPackFormat) NativeTypes() NativeTypes {
+	return NativeTypes{Dates: true, Binary: true, Ext: true}
+}
+
+func (f *MsgPackFormat) AddFlags(fs *flag.FlagSet) {
+	fs.Func("msgpack-timestamps", "msgpack input: how to read timestamps: rfc3339 (strings like 2020-01-02T03:04:05Z), unix (seconds since 1970) or date (like {\"$date\": \"2020-01-02T03:04:05Z\"}, which are written back as timestamps) (default rfc3339)", func(s string) error {
+		switch s {
+		case "rfc3339", "unix", "date":
+			f.Timestamps = s
+			return nil
+		}
+		return fmt.Errorf("expected rfc3339, unix or date")
+	})
+	fs.Func("msgpack-bytes", "msgpack output: how to write binary data (objects like {\"$binary\": ...}): bin or str (default bin)", func(s string) error {
+		switch s {
+		case "bin", "str":
+			f.Bytes = s
+			return nil
+		}
+		return fmt.Errorf("expected bin or str")
+	})
+}
+
 func (f *MsgPackFormat) Input(b []byte) (any, error) {
-	var data any
-	err := msgpack.Unmarshal(b, &data)
-	return data, err
+	return f.value(msgpack_decoder(bytes.NewReader(b)))
 }
 
 func (f *MsgPackFormat) Output(a any, _ bool) ([]byte, error) {
-	rv, err := msgpack.Marshal(a)
-	return rv, err
+	a, err := map_scalars(a, func(v any) (any, error) {
+		if n, ok := v.(*big.Int); ok {
+			if !n.IsUint64() {
+				return nil, fmt.Errorf("msgpack integers are limited to 64 bits, so it cannot represent %s", n)
+			}
+			return n.Uint64(), nil
+		}
+		if b, ok := v.([]byte); ok && f.Bytes == "str" {
+			return string(b), nil
+		}
+		return v, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(a)
+}
+
+// Returns a decoder which allows map keys which aren't strings, rather than
+// failing on them.  normalize formats them.
+func msgpack_decoder(r io.Reader) *msgpack.Decoder {
+	dec := msgpack.NewDecoder(r)
+	dec.SetMapDecoder(func(d *msgpack.Decoder) (any, error) {
+		return d.DecodeUntypedMap()
+	})
+	return dec
+}
+
+func (f *MsgPackFormat) NewDecoder(r io.Reader) DocumentDecoder {
+	// msgpack values are self-delimiting, so they can just be concatenated
+	dec := msgpack_decoder(r)
+	return decoderFunc(func() (any, error) {
+		return f.value(dec)
+	})
+}
+
+// Decodes the next value.  The decoder only knows about the timestamp
+// extension, and fails on any others, so arrays and maps are walked here to
+// catch extensions wherever they are.
+func (f *MsgPackFormat) value(dec *msgpack.Decoder) (any, error) {
+	c, err := dec.PeekCode()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case msgpcode.IsExt(c):
+		return f.ext(dec)
+	case msgpcode.IsFixedArray(c) || c == msgpcode.Array16 || c == msgpcode.Array32:
+		n, err := dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		arr := make([]any, n)
+		for i := range arr {
+			if arr[i], err = f.value(dec); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	case msgpcode.IsFixedMap(c) || c == msgpcode.Map16 || c == msgpcode.Map32:
+		n, err := dec.DecodeMapLen()
+		if err != nil {
+			return nil, err
+		}
+		// keys which aren't strings are formatted now, since some of them
+		// (bin, arrays and maps) can't be keys of a map[any]any
+		obj := make(map[string]any, n)
+		for i := 0; i < n; i++ {
+			key, err := f.value(dec)
+			if err != nil {
+				return nil, err
+			}
+			if obj[normalize_key(key)], err = f.value(dec); err != nil {
+				return nil, err
+			}
+		}
+		return obj, nil
+	}
+	return dec.DecodeInterface()
+}
+
+// Decodes an extension: a timestamp, in the form chosen by Timestamps, or
+// else {"$ext": n, "data": "..."} with the data in base64.
+func (f *MsgPackFormat) ext(dec *msgpack.Decoder) (any, error) {
+	raw, err := dec.DecodeRaw()
+	if err != nil {
+		return nil, err
+	}
+	id, n, err := msgpack.NewDecoder(bytes.NewReader(raw)).DecodeExtHeader()
+	if err != nil {
+		return nil, err
+	}
+	if id != -1 {
+		return map[string]any{"$ext": int(id), "data": base64.StdEncoding.EncodeToString(raw[len(raw)-n:])}, nil
+	}
+	var t time.Time
+	if err := msgpack.Unmarshal(raw, &t); err != nil {
+		return nil, err
+	}
+	t = t.UTC()
+	switch f.Timestamps {
+	case "unix":
+		if t.Nanosecond() == 0 {
+			return big_int(big.NewInt(t.Unix())), nil
+		}
+		return float64(t.UnixNano()) / 1e9, nil
+	case "date":
+		return t, nil // which normalize tags as a $date, like other formats' dates
+	}
+	return t.Format(time.RFC3339Nano), nil
+}
+
+// An extension type which isn't a timestamp, to be written out again.
+type msgpackExt struct {
+	ID   int8
+	Data []byte
+}
+
+func (e msgpackExt) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if err := enc.EncodeExtHeader(e.ID, len(e.Data)); err != nil {
+		return err
+	}
+	_, err := enc.Writer().Write(e.Data)
+	return err
 }
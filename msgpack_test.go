@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMsgPackKeys(t *testing.T) {
+	tests := []struct {
+		input string
+		want  map[string]any
+	}{
+		{"\x81\xa1k\x01", map[string]any{"k": 1}},
+		{"\x81\x05\x01", map[string]any{"5": 1}},
+		{"\x81\xc0\x01", map[string]any{"null": 1}},
+		// bin, arrays and maps can't be keys of a go map
+		{"\x81\xc4\x01k\x01", map[string]any{`{"$binary":{"base64":"aw==","subType":"00"}}`: 1}},
+		{"\x81\x92\x01\x02\x01", map[string]any{"[1,2]": 1}},
+		{"\x81\x81\xa1a\x01\x01", map[string]any{`{"a":1}`: 1}},
+		{"\x81\xa1m\x81\xc4\x01k\x01", map[string]any{"m": map[string]any{`{"$binary":{"base64":"aw==","subType":"00"}}`: 1}}},
+	}
+	for _, test := range tests {
+		got, err := formats["msgpack"].Input([]byte(test.input))
+		if err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+		if got = normalize(got); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %#v, want %#v", test.input, got, test.want)
+		}
+	}
+}
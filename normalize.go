@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The decoders return all sorts of types which gojq doesn't understand, so
+// everything which is read goes through normalize first.  What comes out is
+// made of nil, bool, int, *big.Int, float64, string, []any and map[string]any:
+//
+//   - numbers become int, or *big.Int if they don't fit, or float64
+//   - objects with keys which aren't strings get their keys formatted
+//   - dates and times, binary data, and the bson types which have no
+//     equivalent, become objects in the style of MongoDB's extended json, like
+//     {"$date": "..."} (in RFC 3339 format, or like 1979-05-27 and 07:32:00
+//     for toml's local dates and times), {"$oid": "..."} and
+//     {"$binary": {"base64": "...", "subType": "00"}}, and msgpack extensions
+//     become {"$ext": n, "data": "..."}
+//
+// On the way out, denormalize turns them back into native types, for the
+// formats which have them (see NativeFormat).
+
+// Converts a decoded value into one gojq can work with.  Objects and arrays are
+// converted in place.
+func normalize(v any) any {
+	if n, ok := number_value(v); ok {
+		return n
+	}
+	switch v := v.(type) {
+	case nil, bool, string, float64:
+		return v
+	case map[string]any:
+		for key, value := range v {
+			v[key] = normalize(value)
+		}
+		return v
+	case []any:
+		for i, value := range v {
+			v[i] = normalize(value)
+		}
+		return v
+	case map[any]any:
+		obj := make(map[string]any, len(v))
+		for key, value := range v {
+			obj[normalize_key(key)] = normalize(value)
+		}
+		return obj
+	case primitive.D:
+		obj := make(map[string]any, len(v))
+		for _, elem := range v {
+			obj[elem.Key] = normalize(elem.Value)
+		}
+		return obj
+	case primitive.M:
+		return normalize(map[string]any(v))
+	case primitive.A:
+		return normalize([]any(v))
+	case time.Time:
+		return tagged("$date", v.Format(time.RFC3339Nano))
+	case toml.LocalDate:
+		return tagged("$date", v.String())
+	case toml.LocalTime:
+		return tagged("$date", v.String())
+	case toml.LocalDateTime:
+		return tagged("$date", v.String())
+	case []byte:
+		return tagged("$binary", map[string]any{"base64": base64.StdEncoding.EncodeToString(v), "subType": "00"})
+	case primitive.Binary:
+		return tagged("$binary", map[string]any{"base64": base64.StdEncoding.EncodeToString(v.Data), "subType": hex.EncodeToString([]byte{v.Subtype})})
+	case primitive.ObjectID:
+		return tagged("$oid", v.Hex())
+	case primitive.DateTime:
+		return tagged("$date", v.Time().UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+	case primitive.Decimal128:
+		return tagged("$numberDecimal", v.String())
+	case primitive.Timestamp:
+		return tagged("$timestamp", map[string]any{"t": int(v.T), "i": int(v.I)})
+	case primitive.Regex:
+		return tagged("$regularExpression", map[string]any{"pattern": v.Pattern, "options": v.Options})
+	case primitive.JavaScript:
+		return tagged("$code", string(v))
+	case primitive.CodeWithScope:
+		return map[string]any{"$code": string(v.Code), "$scope": normalize(v.Scope)}
+	case primitive.Symbol:
+		return tagged("$symbol", string(v))
+	case primitive.DBPointer:
+		return tagged("$dbPointer", map[string]any{"$ref": v.DB, "$id": tagged("$oid", v.Pointer.Hex())})
+	case primitive.MinKey:
+		return tagged("$minKey", 1)
+	case primitive.MaxKey:
+		return tagged("$maxKey", 1)
+	case primitive.Undefined:
+		return tagged("$undefined", true)
+	case primitive.Null:
+		return nil
+	case stringable:
+		return v.String()
+	}
+	return fmt.Sprint(v)
+}
+
+func tagged(tag string, value any) map[string]any {
+	return map[string]any{tag: value}
+}
+
+// Formats an object key which isn't a string, like the 1 in yaml's {1: one}.
+// Arrays and objects (including tagged ones, like binary data) are written as
+// json.
+func normalize_key(key any) string {
+	switch key := normalize(key).(type) {
+	case nil:
+		return "null"
+	case string:
+		return key
+	case []any, map[string]any:
+		b, err := json.Marshal(key)
+		if err != nil {
+			return fmt.Sprint(key)
+		}
+		return string(b)
+	default:
+		return fmt.Sprint(key)
+	}
+}
+
+// The types which a format can hold natively, so denormalize should turn them
+// back into what its encoder expects.
+type NativeTypes struct {
+	Dates      bool // {"$date": ...} becomes time.Time
+	LocalDates bool // {"$date": "1979-05-27"}, and local times and datetimes, become toml's local types
+	Binary     bool // {"$binary": ...} becomes []byte
+	BSON       bool // the rest of the tagged objects become bson types, and binary data keeps its subtype
+	Ext        bool // {"$ext": n, "data": ...} becomes a msgpack extension
+}
+
+// Returns a copy of v, with the values which normalize made from native types
+// turned back into those types.  Anything which can't be converted is left as
+// it is.
+func denormalize(v any, native NativeTypes) any {
+	switch v := v.(type) {
+	case map[string]any:
+		if len(v) <= 2 {
+			if rv, ok := denormalize_tagged(v, native); ok {
+				return rv
+			}
+		}
+		obj := make(map[string]any, len(v))
+		for key, value := range v {
+			obj[key] = denormalize(value, native)
+		}
+		return obj
+	case []any:
+		arr := make([]any, len(v))
+		for i, value := range v {
+			arr[i] = denormalize(value, native)
+		}
+		return arr
+	}
+	return v
+}
+
+// Converts one of the tagged objects made by normalize.
+func denormalize_tagged(obj map[string]any, native NativeTypes) (any, bool) {
+	if len(obj) == 2 {
+		code, ok1 := obj["$code"].(string)
+		scope, ok2 := obj["$scope"].(map[string]any)
+		if ok1 && ok2 && native.BSON {
+			return primitive.CodeWithScope{Code: primitive.JavaScript(code), Scope: denormalize(scope, native)}, true
+		}
+		id, ok1 := obj["$ext"].(int)
+		data, ok2 := obj["data"].(string)
+		if ok1 && ok2 && native.Ext && id >= math.MinInt8 && id <= math.MaxInt8 {
+			if b, err := base64.StdEncoding.DecodeString(data); err == nil {
+				return msgpackExt{ID: int8(id), Data: b}, true
+			}
+		}
+		return nil, false
+	}
+	for tag, value := range obj {
+		s, isstring := value.(string)
+		fields, _ := value.(map[string]any)
+		switch {
+		case tag == "$date" && isstring && (native.Dates || native.LocalDates):
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil && native.Dates {
+				return t, true
+			}
+			if local, ok := toml_local(s); ok && native.LocalDates {
+				return local, true
+			}
+		case tag == "$binary" && (native.Binary || native.BSON):
+			b64, _ := fields["base64"].(string)
+			subtype, _ := fields["subType"].(string)
+			data, err := base64.StdEncoding.DecodeString(b64)
+			st, err2 := hex.DecodeString(subtype)
+			if err != nil || err2 != nil || len(st) != 1 {
+				return nil, false
+			}
+			if native.BSON {
+				return primitive.Binary{Subtype: st[0], Data: data}, true
+			} else if st[0] == 0 {
+				return data, true
+			}
+		case !native.BSON:
+			return nil, false
+		case tag == "$oid":
+			if id, err := primitive.ObjectIDFromHex(s); err == nil {
+				return id, true
+			}
+		case tag == "$numberLong":
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return n, true
+			}
+		case tag == "$numberDecimal":
+			if d, err := primitive.ParseDecimal128(s); err == nil {
+				return d, true
+			}
+		case tag == "$timestamp":
+			t, ok1 := fields["t"].(int)
+			i, ok2 := fields["i"].(int)
+			if ok1 && ok2 && len(fields) == 2 {
+				return primitive.Timestamp{T: uint32(t), I: uint32(i)}, true
+			}
+		case tag == "$regularExpression":
+			pattern, ok1 := fields["pattern"].(string)
+			options, ok2 := fields["options"].(string)
+			if ok1 && ok2 && len(fields) == 2 {
+				return primitive.Regex{Pattern: pattern, Options: options}, true
+			}
+		case tag == "$code" && isstring:
+			return primitive.JavaScript(s), true
+		case tag == "$symbol" && isstring:
+			return primitive.Symbol(s), true
+		case tag == "$dbPointer":
+			ref, ok := fields["$ref"].(string)
+			oid, _ := fields["$id"].(map[string]any)
+			if id, err := primitive.ObjectIDFromHex(fmt.Sprint(oid["$oid"])); err == nil && ok && len(oid) == 1 {
+				return primitive.DBPointer{DB: ref, Pointer: id}, true
+			}
+		case tag == "$minKey" && value == 1:
+			return primitive.MinKey{}, true
+		case tag == "$maxKey" && value == 1:
+			return primitive.MaxKey{}, true
+		case tag == "$undefined" && value == true:
+			return primitive.Undefined{}, true
+		}
+	}
+	return nil, false
+}
+
+// Returns the types a format can hold natively.
+func native_types(f Format) NativeTypes {
+	if nf, ok := f.(NativeFormat); ok {
+		return nf.NativeTypes()
+	}
+	return NativeTypes{}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+)
+
+// Numbers come out of the decoders as all sorts of types.  gojq works with int,
+// *big.Int (for integers which don't fit in an int) and float64, so normalize
+// converts them to those, and each format turns big integers into whatever it
+// has for them on the way out.
+
+var json_int_re = regexp.MustCompile(`^-?[0-9]+$`)
+
+// Converts any kind of number to an int, *big.Int or float64.  Returns false
+// if v isn't a number.
+func number_value(v any) (any, bool) {
+	switch v := v.(type) {
+	case int:
+		return v, true
+	case float64:
+		return clamp_float(v), true
+	case json.Number:
+		return json_number(v), true
+	case int8:
+		return int(v), true
+	case int16:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case int64:
+		return big_int(new(big.Int).SetInt64(v)), true
+	case uint8:
+		return int(v), true
+	case uint16:
+		return int(v), true
+	case uint32:
+		return big_int(new(big.Int).SetUint64(uint64(v))), true
+	case uint:
+		return big_int(new(big.Int).SetUint64(uint64(v))), true
+	case uint64:
+		return big_int(new(big.Int).SetUint64(v)), true
+	case float32:
+		return clamp_float(float64(v)), true
+	case *big.Int:
+		return big_int(v), true
+	}
+	return nil, false
+}
+
+// Returns an integer as an int, if it fits, or else as a *big.Int.
+func big_int(n *big.Int) any {
+	if n.IsInt64() && n.Int64() >= math.MinInt && n.Int64() <= math.MaxInt {
+		return int(n.Int64())
+	}
+	return n
+}
+
+// Converts a number from number_value to a *big.Float, for comparing them.
+func big_float(n any) *big.Float {
+	switch n := n.(type) {
+	case int:
+		return new(big.Float).SetInt64(int64(n))
+	case *big.Int:
+		return new(big.Float).SetInt(n)
+	}
+	return big.NewFloat(n.(float64))
+}
+
+// Converts a json number without losing any digits, if it's an integer.
+func json_number(n json.Number) any {
+	if json_int_re.MatchString(string(n)) {
+		if i, ok := new(big.Int).SetString(string(n), 10); ok {
+			return big_int(i)
+		}
+	}
+	f, _ := parse_float(string(n))
+	return f
+}
+
+// Parses a float, which is clamped to ±math.MaxFloat64 if it's out of range,
+// like jq does.
+func parse_float(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return 0, false
+	}
+	return clamp_float(f), true
+}
+
+// Turns infinities into the biggest finite floats, which json can hold.
+func clamp_float(f float64) float64 {
+	if math.IsInf(f, 1) {
+		return math.MaxFloat64
+	} else if math.IsInf(f, -1) {
+		return -math.MaxFloat64
+	}
+	return f
+}
+
+// Returns a copy of v with each number (or anything else which isn't an object
+// or an array) replaced by fn, for formats which need something other than
+// *big.Int for big integers.  The original is left alone, since it might be
+// written out again in another format.
+func map_scalars(v any, fn func(any) (any, error)) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		rv := make(map[string]any, len(v))
+		for key, value := range v {
+			value, err := map_scalars(value, fn)
+			if err != nil {
+				return nil, err
+			}
+			rv[key] = value
+		}
+		return rv, nil
+	case []any:
+		rv := make([]any, len(v))
+		for i, value := range v {
+			value, err := map_scalars(value, fn)
+			if err != nil {
+				return nil, err
+			}
+			rv[i] = value
+		}
+		return rv, nil
+	}
+	return fn(v)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Replaces a file with new contents, atomically: the new contents go into a
+// temporary file in the same directory, which then gets renamed over the
+// original.  The original's permissions are kept.  If backup_suffix is given,
+// the original is kept under that name as well.
+func replace_file(fn string, data []byte, backup_suffix string) (err error) {
+	// write through symlinks, rather than replacing them
+	fn, err = filepath.EvalSymlinks(fn)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(fn)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(fn)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if backup_suffix != "" {
+		if err = backup_file(fn, fn+backup_suffix); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(tmp.Name(), fn); err != nil {
+		return err
+	}
+
+	// make the rename itself durable too; not every platform can do this
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// Keeps a copy of fn as backup, replacing any older backup.  This uses a hard
+// link where it can, so the original file stays where it is until the
+// replacement is renamed over it.
+func backup_file(fn, backup string) error {
+	if err := os.Remove(backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(fn, backup); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(backup, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
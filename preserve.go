@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Helpers for formats which implement PreservingFormat.
+
+// Compares a value decoded from the original document with one returned by
+// gojq.  Numbers compare by value, since the decoders and gojq don't always
+// agree on which Go type to use for them.
+func same_value(a, b any) bool {
+	if an, ok := number_value(a); ok {
+		bn, ok := number_value(b)
+		return ok && big_float(an).Cmp(big_float(bn)) == 0
+	}
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, avalue := range a {
+			bvalue, ok := b[key]
+			if !ok || !same_value(avalue, bvalue) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !same_value(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case time.Time:
+		// DeepEqual would compare the *time.Location, which differs between
+		// two parses of the same offset
+		b, ok := b.(time.Time)
+		return ok && a.Format(time.RFC3339Nano) == b.Format(time.RFC3339Nano)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func sorted_keys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A replacement of orig[start:end] with text.  Insertions have start == end.
+type textEdit struct {
+	start int
+	end   int
+	text  string
+}
+
+// Applies non-overlapping edits to the original document.  Insertions at the
+// same position end up in the order they were given.
+func apply_edits(orig []byte, edits []textEdit) []byte {
+	sort.SliceStable(edits, func(i, j int) bool {
+		if edits[i].start != edits[j].start {
+			return edits[i].start < edits[j].start
+		}
+		return edits[i].end < edits[j].end
+	})
+	rv := make([]byte, 0, len(orig))
+	pos := 0
+	for _, edit := range edits {
+		if edit.start < pos {
+			// overlaps an earlier edit; callers shouldn't do this
+			continue
+		}
+		rv = append(rv, orig[pos:edit.start]...)
+		if edit.start == len(orig) && len(rv) > 0 && rv[len(rv)-1] != '\n' && edit.text != "" {
+			rv = append(rv, '\n')
+		}
+		rv = append(rv, edit.text...)
+		pos = edit.end
+	}
+	rv = append(rv, orig[pos:]...)
+	return rv
+}
+
+// Returns the offset of the start of the line containing offset pos.
+func line_start(b []byte, pos int) int {
+	for pos > 0 && b[pos-1] != '\n' {
+		pos--
+	}
+	return pos
+}
+
+// Returns the offset just past the end of the line containing offset pos,
+// including its newline.
+func line_end(b []byte, pos int) int {
+	for pos < len(b) && b[pos] != '\n' {
+		pos++
+	}
+	if pos < len(b) {
+		pos++
+	}
+	return pos
+}
+
+// Moves pos back over any blank lines before it, and over comment lines too,
+// if they start with one of the characters in comments.  pos should be the
+// start of a line.
+func skip_back(b []byte, pos int, comments string) int {
+	for pos > 0 {
+		prev := line_start(b, pos-1)
+		line := bytes.TrimSpace(b[prev:pos])
+		if len(line) > 0 && !strings.ContainsRune(comments, rune(line[0])) {
+			break
+		}
+		pos = prev
+	}
+	return pos
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/itchyny/gojq"
+)
+
+// Runs expr on orig, the way --preserve does, and returns the patched text.
+func preserve(t *testing.T, fmtname, orig, expr string) string {
+	t.Helper()
+	f := formats[fmtname]
+	input, err := f.Input([]byte(orig))
+	if err != nil {
+		t.Fatalf("could not decode %q as %s: %v", orig, fmtname, err)
+	}
+	query, err := gojq.Parse(expr)
+	if err != nil {
+		t.Fatalf("could not parse %q: %v", expr, err)
+	}
+	code, err := gojq.Compile(query)
+	if err != nil {
+		t.Fatalf("could not compile %q: %v", expr, err)
+	}
+	result, ok := code.Run(normalize(input)).Next()
+	if !ok {
+		t.Fatalf("%q returned nothing", expr)
+	}
+	if err, ok := result.(error); ok {
+		t.Fatalf("%q failed: %v", expr, err)
+	}
+	out, err := f.(PreservingFormat).Patch([]byte(orig), result, true)
+	if err != nil {
+		t.Fatalf("could not patch %s with %q: %v", fmtname, expr, err)
+	}
+	return string(out)
+}
+
+type preserveTest struct {
+	expr string
+	want string
+}
+
+func run_preserve_tests(t *testing.T, fmtname, orig string, tests []preserveTest) {
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			if got := preserve(t, fmtname, orig, test.expr); got != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+const yaml_sample = `# settings
+base: &base
+  x: 1   # the x
+  y: two
+when: 2001-12-14T21:59:43Z
+child:
+  <<: *base
+  z: 3
+
+list:
+  - a
+  - "b"   # bee
+flow: {a: 1, b: [1, 2]}
+text: |
+  hello
+  world
+`
+
+func TestPreserveYAML(t *testing.T) {
+	run_preserve_tests(t, "yaml", yaml_sample, []preserveTest{
+		{".", yaml_sample},
+		{".child.z = 4", `# settings
+base: &base
+  x: 1   # the x
+  y: two
+when: 2001-12-14T21:59:43Z
+child:
+  <<: *base
+  z: 4
+
+list:
+  - a
+  - "b"   # bee
+flow: {a: 1, b: [1, 2]}
+text: |
+  hello
+  world
+`},
+		{`.list[1] = "c" | .list += ["d"] | .flow.b += [3] | .text = "bye"`, `# settings
+base: &base
+  x: 1   # the x
+  y: two
+when: 2001-12-14T21:59:43Z
+child:
+  <<: *base
+  z: 3
+
+list:
+  - a
+  - "c"   # bee
+  - d
+flow: {a: 1, b: [1, 2, 3]}
+text: bye
+`},
+		{"del(.when) | .new = {a: 1}", `# settings
+base: &base
+  x: 1   # the x
+  y: two
+child:
+  <<: *base
+  z: 3
+
+list:
+  - a
+  - "b"   # bee
+flow: {a: 1, b: [1, 2]}
+text: |
+  hello
+  world
+new:
+  a: 1
+`},
+		// the merged values would change too, so they're written out instead
+		{".base.x = 5", `# settings
+base: &base
+  x: 5   # the x
+  y: two
+when: 2001-12-14T21:59:43Z
+child:
+  x: 1
+  "y": two
+  z: 3
+
+list:
+  - a
+  - "b"   # bee
+flow: {a: 1, b: [1, 2]}
+text: |
+  hello
+  world
+`},
+	})
+}
+
+const toml_sample = `# settings
+title = "example"   # the title
+born = 1979-05-27
+version = "2024-01-01"
+
+[server]
+host = "localhost"
+port = 8080
+`
+
+func TestPreserveTOML(t *testing.T) {
+	run_preserve_tests(t, "toml", toml_sample, []preserveTest{
+		{".", toml_sample},
+		{`.title = "y"`, `# settings
+title = "y"   # the title
+born = 1979-05-27
+version = "2024-01-01"
+
+[server]
+host = "localhost"
+port = 8080
+`},
+		{`.server.port = 9090 | .server.tls = true | del(.server.host)`, `# settings
+title = "example"   # the title
+born = 1979-05-27
+version = "2024-01-01"
+
+[server]
+port = 9090
+tls = true
+`},
+		{`.born = {"$date": "2000-01-01"} | .version = "2024-02-02"`, `# settings
+title = "example"   # the title
+born = 2000-01-01
+version = "2024-02-02"
+
+[server]
+host = "localhost"
+port = 8080
+`},
+		{`.db = {name: "x"}`, `# settings
+title = "example"   # the title
+born = 1979-05-27
+version = "2024-01-01"
+db = { name = "x" }
+
+[server]
+host = "localhost"
+port = 8080
+`},
+	})
+}
+
+const ini_sample = `; settings
+name = example
+path = "C:\\x y"
+
+[server]
+host = localhost
+port = 8080
+`
+
+func TestPreserveINI(t *testing.T) {
+	run_preserve_tests(t, "ini", ini_sample, []preserveTest{
+		{".", ini_sample},
+		{`.server.port = "9090"`, `; settings
+name = example
+path = "C:\\x y"
+
+[server]
+host = localhost
+port = 9090
+`},
+		{`.server.tls = "yes" | del(.server.host)`, `; settings
+name = example
+path = "C:\\x y"
+
+[server]
+port = 8080
+tls = yes
+`},
+		{`.path = "D:\\z"`, `; settings
+name = example
+path = D:\z
+
+[server]
+host = localhost
+port = 8080
+`},
+	})
+}
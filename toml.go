@@ -2,8 +2,16 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
 )
 
 type TOMLFormat struct {
@@ -23,24 +31,635 @@ func (f *TOMLFormat) GetFeatures() FormatFeatures {
 		Can_scalar:      false,
 		Can_array:       false, // can emit arrays but not parse them
 		Can_object:      true,
+		Can_multidoc:    false,
 		Is_binary:       false,
 		Arbitrary_tree:  true,
 		Universal:       true,
 	}
 }
 
+func (f *TOMLFormat) NativeTypes() NativeTypes {
+	return NativeTypes{Dates: true, LocalDates: true}
+}
+
 func (f *TOMLFormat) Input(b []byte) (any, error) {
 	var data any
 	err := toml.Unmarshal(b, &data)
 	return data, err
 }
 
+// Parses a local date, time or datetime, like 1979-05-27, 07:32:00 or
+// 1979-05-27T07:32:00.
+func toml_local(s string) (any, bool) {
+	var date toml.LocalDate
+	var tod toml.LocalTime
+	var datetime toml.LocalDateTime
+	switch {
+	case len(s) == 10 && date.UnmarshalText([]byte(s)) == nil:
+		return date, true
+	case len(s) >= 8 && s[2] == ':' && tod.UnmarshalText([]byte(s)) == nil:
+		return tod, true
+	case len(s) >= 19 && s[10] == 'T' && datetime.UnmarshalText([]byte(s)) == nil:
+		return datetime, true
+	}
+	return nil, false
+}
+
 func (f *TOMLFormat) Output(a any, prettyprint bool) ([]byte, error) {
+	a, err := map_scalars(a, func(v any) (any, error) {
+		if _, ok := v.(*big.Int); ok {
+			return nil, fmt.Errorf("toml integers are limited to 64 bits, so it cannot represent %s", v)
+		}
+		return v, nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	b := bytes.NewBuffer([]byte{})
 	e := toml.NewEncoder(b)
 	if prettyprint {
 		e.SetIndentTables(true)
 	}
-	err := e.Encode(a)
+	err = e.Encode(a)
 	return b.Bytes(), err
 }
+
+// A key/value line or table header in an existing toml document, found by
+// toml_scan.
+type tomlEntry struct {
+	kind     unstable.Kind // KeyValue, Table or ArrayTable
+	keys     []string      // as written, relative to the table for KeyValue
+	path     []any         // absolute, with indices for arrays of tables
+	start    int           // start of the line(s)
+	end      int           // end of the line(s), past the newline
+	valstart int           // KeyValue only
+	valend   int           // KeyValue only
+}
+
+// Where new keys for a table can be inserted.  The root table has one too.
+type tomlBlock struct {
+	path       []any
+	insertAt   int // after the header, or the last key/value line
+	subtreeEnd int // before the next header which isn't a sub-table of this one
+}
+
+type tomlDoc struct {
+	orig    []byte
+	entries []*tomlEntry
+	blocks  map[string]*tomlBlock
+	kvs     map[string]bool       // paths of key/value lines
+	dotted  map[string]*tomlBlock // tables made by dotted keys, and where those are
+	arrays  map[string]int        // arrays of tables, and how many elements
+	edits   []textEdit
+	pending map[string]*textEdit // new tables, which don't exist in orig yet
+}
+
+func (f *TOMLFormat) Colorize(b []byte, c *Colors) []byte {
+	w := bytes.NewBuffer(make([]byte, 0, 2*len(b)))
+	depth := 0 // inside an inline array or table
+	linestart := true
+	for i := 0; i < len(b); {
+		ch := b[i]
+		n := 1
+		switch {
+		case ch == '\n':
+			w.WriteByte(ch)
+			i++
+			linestart = true
+			continue
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			w.WriteByte(ch)
+			i++
+			continue
+		case ch == '#':
+			n = bytes.IndexByte(b[i:], '\n')
+			if n < 0 {
+				n = len(b) - i
+			}
+			c.paint(w, c.Null, b[i:i+n])
+		case ch == '[' && linestart && depth == 0:
+			// a table header, or an array of tables
+			open, close, sgr := "[", "]", c.Object
+			if bytes.HasPrefix(b[i:], []byte("[[")) {
+				open, close, sgr = "[[", "]]", c.Array
+			}
+			line := b[i:]
+			if end := bytes.IndexByte(line, '\n'); end >= 0 {
+				line = line[:end]
+			}
+			name := line[len(open):]
+			if end := bytes.Index(name, []byte(close)); end >= 0 {
+				name = name[:end]
+			}
+			c.paint(w, sgr, []byte(open))
+			c.paint(w, c.Key, name)
+			n = len(open) + len(name)
+			if bytes.HasPrefix(b[i+n:], []byte(close)) {
+				c.paint(w, sgr, []byte(close))
+				n += len(close)
+			}
+		case bytes.HasPrefix(b[i:], []byte(`"""`)) || bytes.HasPrefix(b[i:], []byte("'''")):
+			n = quoted_len(b[i:], string(b[i:i+3]), ch == '"')
+			c.paint(w, c.String, b[i:i+n])
+		case ch == '[' || ch == ']' || ch == '{' || ch == '}':
+			if ch == '[' || ch == '{' {
+				depth++
+			} else {
+				depth--
+			}
+			sgr := c.Array
+			if ch == '{' || ch == '}' {
+				sgr = c.Object
+			}
+			c.paint(w, sgr, b[i:i+1])
+		case ch == '=' || ch == ',':
+			c.paint(w, c.Object, b[i:i+1])
+		default:
+			sgr := c.String
+			if ch == '"' || ch == '\'' {
+				n = quoted_len(b[i:], string(ch), ch == '"')
+			} else {
+				n = bytes.IndexAny(b[i:], " \t\r\n,=[]{}#\"'")
+				if n < 0 {
+					n = len(b) - i
+				}
+				// bare words which aren't literals can only be keys
+				var ok bool
+				if sgr, ok = c.literal(b[i : i+n]); !ok {
+					sgr = c.Key
+				}
+			}
+			if rest := bytes.TrimLeft(b[i+n:], " \t"); len(rest) > 0 && (rest[0] == '=' || rest[0] == '.') {
+				sgr = c.Key
+			}
+			c.paint(w, sgr, b[i:i+n])
+		}
+		i += n
+		linestart = false
+	}
+	return w.Bytes()
+}
+
+func (f *TOMLFormat) Patch(orig []byte, a any, _ bool) ([]byte, error) {
+	obj, ok := denormalize(a, f.NativeTypes()).(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("toml output only supports objects at the top level")
+	}
+	input, err := f.Input(orig)
+	if err != nil {
+		return nil, err
+	}
+	old, _ := denormalize(normalize(input), f.NativeTypes()).(map[string]any)
+	doc, err := toml_scan(orig)
+	if err != nil {
+		return nil, err
+	}
+
+	// rewrite or remove what's there already
+	for _, entry := range doc.entries {
+		newvalue, ok := toml_lookup(obj, entry.path)
+		if entry.kind != unstable.KeyValue {
+			if _, ismap := newvalue.(map[string]any); !ok || !ismap {
+				// take the blank lines before it as well
+				start := skip_back(orig, entry.start, "")
+				doc.edits = append(doc.edits, textEdit{start, entry.end, ""})
+			}
+			continue
+		}
+		if !ok {
+			doc.edits = append(doc.edits, textEdit{entry.start, entry.end, ""})
+			continue
+		}
+		oldvalue, _ := toml_lookup(old, entry.path)
+		if same_value(oldvalue, newvalue) {
+			continue
+		}
+		text, err := toml_inline(newvalue)
+		if err != nil {
+			return nil, fmt.Errorf("at %s: %w", toml_key_path(entry.path), err)
+		}
+		doc.edits = append(doc.edits, textEdit{entry.valstart, entry.valend, text})
+	}
+
+	// then add what's new
+	if err := doc.add_missing([]any{}, obj, old); err != nil {
+		return nil, err
+	}
+	for _, edit := range doc.pending {
+		doc.edits = append(doc.edits, *edit)
+	}
+	return apply_edits(orig, doc.edits), nil
+}
+
+// Finds the key/value lines and table headers in a toml document.
+func toml_scan(orig []byte) (*tomlDoc, error) {
+	doc := &tomlDoc{
+		orig:    orig,
+		blocks:  map[string]*tomlBlock{},
+		kvs:     map[string]bool{},
+		dotted:  map[string]*tomlBlock{},
+		arrays:  map[string]int{},
+		pending: map[string]*textEdit{},
+	}
+	root := &tomlBlock{path: []any{}, insertAt: 0, subtreeEnd: len(orig)}
+	doc.blocks[""] = root
+	block := root
+	var headers []*tomlEntry
+
+	p := unstable.Parser{KeepComments: true}
+	p.Reset(orig)
+	var last *tomlEntry // value end isn't known until the next expression starts
+	lastComment := -1
+	finish := func(next int) {
+		if last == nil {
+			return
+		}
+		end := next
+		if lastComment >= 0 {
+			end = lastComment
+		}
+		for end > last.valstart && strings.ContainsRune(" \t\r\n", rune(orig[end-1])) {
+			end--
+		}
+		last.valend = end
+		last.end = line_end(orig, end)
+		if lastComment >= 0 {
+			last.end = line_end(orig, lastComment)
+		}
+		last = nil
+	}
+
+	for p.NextExpression() {
+		expr := p.Expression()
+		if expr.Kind == unstable.Comment {
+			finish(int(expr.Raw.Offset))
+			continue
+		}
+		entry := &tomlEntry{kind: expr.Kind}
+		keyend := 0
+		it := expr.Key()
+		for it.Next() {
+			key := it.Node()
+			if len(entry.keys) == 0 {
+				entry.start = int(key.Raw.Offset)
+			}
+			entry.keys = append(entry.keys, string(key.Data))
+			keyend = int(key.Raw.Offset + key.Raw.Length)
+		}
+		if expr.Kind != unstable.KeyValue {
+			for entry.start > 0 && orig[entry.start] != '[' {
+				entry.start--
+			}
+			for entry.start > 0 && orig[entry.start-1] == '[' {
+				entry.start--
+			}
+		}
+		finish(entry.start)
+		lastComment = -1
+		if comment := expr.Next(); comment != nil && comment.Kind == unstable.Comment {
+			lastComment = int(comment.Raw.Offset)
+		}
+		entry.start = line_start(orig, entry.start)
+
+		switch expr.Kind {
+		case unstable.KeyValue:
+			entry.path = append(append([]any{}, block.path...), toml_strings(entry.keys)...)
+			pos := keyend
+			for pos < len(orig) && (orig[pos] == ' ' || orig[pos] == '\t' || orig[pos] == '=') {
+				pos++
+			}
+			entry.valstart = pos
+			doc.kvs[toml_path_key(entry.path)] = true
+			for i := 1; i < len(entry.keys); i++ {
+				doc.dotted[toml_path_key(entry.path[:len(block.path)+i])] = block
+			}
+			last = entry
+		case unstable.Table, unstable.ArrayTable:
+			entry.path = doc.resolve(entry.keys[:len(entry.keys)-1])
+			entry.path = append(entry.path, entry.keys[len(entry.keys)-1])
+			if expr.Kind == unstable.ArrayTable {
+				arraykey := toml_path_key(entry.path)
+				entry.path = append(entry.path, doc.arrays[arraykey])
+				doc.arrays[arraykey]++
+			}
+			entry.end = line_end(orig, entry.start)
+			if lastComment >= 0 {
+				entry.end = line_end(orig, lastComment)
+			}
+			block = &tomlBlock{path: entry.path, insertAt: entry.end}
+			doc.blocks[toml_path_key(entry.path)] = block
+			headers = append(headers, entry)
+		}
+		doc.entries = append(doc.entries, entry)
+	}
+	if err := p.Error(); err != nil {
+		return nil, err
+	}
+	finish(len(orig))
+
+	// now that everything's been found, work out where to insert things
+	for _, entry := range doc.entries {
+		if entry.kind == unstable.KeyValue {
+			for _, block := range doc.blocks {
+				if toml_has_prefix(entry.path, block.path) && len(entry.path)-len(entry.keys) == len(block.path) {
+					block.insertAt = entry.end
+				}
+			}
+		}
+	}
+	for i, header := range headers {
+		block := doc.blocks[toml_path_key(header.path)]
+		block.subtreeEnd = len(orig)
+		for _, next := range headers[i+1:] {
+			if !toml_has_prefix(next.path, header.path) {
+				block.subtreeEnd = skip_back(orig, next.start, "#")
+				break
+			}
+		}
+	}
+	return doc, nil
+}
+
+// Turns the keys of a table header into a path, picking the latest element of
+// any arrays of tables along the way, the way toml does.
+func (doc *tomlDoc) resolve(keys []string) []any {
+	path := []any{}
+	for _, key := range keys {
+		path = append(path, key)
+		if n, ok := doc.arrays[toml_path_key(path)]; ok {
+			path = append(path, n-1)
+		}
+	}
+	return path
+}
+
+func (doc *tomlDoc) add_missing(path []any, obj, old map[string]any) error {
+	for _, key := range sorted_keys(obj) {
+		childpath := append(append([]any{}, path...), key)
+		value := obj[key]
+		if oldvalue, ok := old[key]; ok {
+			if doc.kvs[toml_path_key(childpath)] {
+				continue // already rewritten in place
+			}
+			if oldobj, ok := oldvalue.(map[string]any); ok {
+				if newobj, ok := value.(map[string]any); ok {
+					if err := doc.add_missing(childpath, newobj, oldobj); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			if oldarr, ok := oldvalue.([]any); ok && doc.arrays[toml_path_key(childpath)] > 0 {
+				if newarr, ok := value.([]any); ok && toml_all_objects(newarr) {
+					for i, elem := range newarr {
+						elempath := append(append([]any{}, childpath...), i)
+						if i < len(oldarr) {
+							if err := doc.add_missing(elempath, elem.(map[string]any), oldarr[i].(map[string]any)); err != nil {
+								return err
+							}
+						} else if err := doc.append_array_element(childpath, len(oldarr)-1, elem.(map[string]any)); err != nil {
+							return err
+						}
+					}
+					continue
+				}
+			}
+			// it changed shape, so the old lines are gone; write it as a new key
+		}
+		if err := doc.insert_key(path, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (doc *tomlDoc) insert_key(path []any, key string, value any) error {
+	text, err := toml_inline(value)
+	if err != nil {
+		return fmt.Errorf("at %s: %w", toml_key_path(append(append([]any{}, path...), key)), err)
+	}
+	line := toml_key(key) + " = " + text + "\n"
+
+	if block, ok := doc.blocks[toml_path_key(path)]; ok {
+		doc.edits = append(doc.edits, textEdit{block.insertAt, block.insertAt, line})
+		return nil
+	}
+	if block, ok := doc.dotted[toml_path_key(path)]; ok {
+		// the table was made with dotted keys, so add another one next to them
+		prefix := toml_key_path(path[len(block.path):]) + "."
+		doc.edits = append(doc.edits, textEdit{block.insertAt, block.insertAt, prefix + line})
+		return nil
+	}
+	// no header for this table yet, so add one, after its closest relative
+	pathkey := toml_path_key(path)
+	if edit, ok := doc.pending[pathkey]; ok {
+		edit.text += line
+		return nil
+	}
+	pos := len(doc.orig)
+	for i := len(path) - 1; i >= 0; i-- {
+		if block, ok := doc.blocks[toml_path_key(path[:i])]; ok {
+			pos = block.subtreeEnd
+			break
+		}
+	}
+	doc.pending[pathkey] = &textEdit{pos, pos, "\n[" + toml_key_path(path) + "]\n" + line}
+	return nil
+}
+
+func (doc *tomlDoc) append_array_element(path []any, lastindex int, obj map[string]any) error {
+	text := "\n[[" + toml_key_path(path) + "]]\n"
+	for _, key := range sorted_keys(obj) {
+		value, err := toml_inline(obj[key])
+		if err != nil {
+			return fmt.Errorf("at %s: %w", toml_key_path(append(append([]any{}, path...), key)), err)
+		}
+		text += toml_key(key) + " = " + value + "\n"
+	}
+	pos := len(doc.orig)
+	if block, ok := doc.blocks[toml_path_key(append(append([]any{}, path...), lastindex))]; ok {
+		pos = block.subtreeEnd
+	}
+	doc.edits = append(doc.edits, textEdit{pos, pos, text})
+	return nil
+}
+
+func toml_lookup(a any, path []any) (any, bool) {
+	for _, segment := range path {
+		switch segment := segment.(type) {
+		case string:
+			obj, ok := a.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			if a, ok = obj[segment]; !ok {
+				return nil, false
+			}
+		case int:
+			arr, ok := a.([]any)
+			if !ok || segment >= len(arr) {
+				return nil, false
+			}
+			a = arr[segment]
+		}
+	}
+	return a, true
+}
+
+func toml_path_key(path []any) string {
+	parts := make([]string, len(path))
+	for i, segment := range path {
+		parts[i] = fmt.Sprintf("%v", segment)
+		if _, ok := segment.(int); ok {
+			parts[i] = "#" + parts[i]
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
+
+func toml_has_prefix(path, prefix []any) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if path[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func toml_strings(keys []string) []any {
+	rv := make([]any, len(keys))
+	for i, key := range keys {
+		rv[i] = key
+	}
+	return rv
+}
+
+func toml_all_objects(arr []any) bool {
+	for _, elem := range arr {
+		if _, ok := elem.(map[string]any); !ok {
+			return false
+		}
+	}
+	return len(arr) > 0
+}
+
+// Writes a dotted key for a path, leaving out array indices.
+func toml_key_path(path []any) string {
+	parts := []string{}
+	for _, segment := range path {
+		if key, ok := segment.(string); ok {
+			parts = append(parts, toml_key(key))
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+var tomlBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func toml_key(key string) string {
+	if tomlBareKey.MatchString(key) {
+		return key
+	}
+	return toml_string(key)
+}
+
+func toml_string(s string) string {
+	b := strings.Builder{}
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Writes a value on a single line, the way it would appear after "key = ".
+func toml_inline(a any) (string, error) {
+	switch v := a.(type) {
+	case nil:
+		return "", fmt.Errorf("toml has no null value")
+	case string:
+		return toml_string(v), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case *big.Int:
+		if !v.IsInt64() {
+			return "", fmt.Errorf("toml integers are limited to 64 bits")
+		}
+		return v.String(), nil
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return "nan", nil
+		case math.IsInf(v, 1):
+			return "inf", nil
+		case math.IsInf(v, -1):
+			return "-inf", nil
+		}
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+		return s, nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case toml.LocalDate:
+		return v.String(), nil
+	case toml.LocalTime:
+		return v.String(), nil
+	case toml.LocalDateTime:
+		return v.String(), nil
+	case []any:
+		parts := make([]string, len(v))
+		for i, elem := range v {
+			s, err := toml_inline(elem)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = s
+		}
+		return "[" + strings.Join(parts, ", ") + "]", nil
+	case map[string]any:
+		parts := []string{}
+		for _, key := range sorted_keys(v) {
+			s, err := toml_inline(v[key])
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, toml_key(key)+" = "+s)
+		}
+		if len(parts) == 0 {
+			return "{}", nil
+		}
+		return "{ " + strings.Join(parts, ", ") + " }", nil
+	}
+	return "", fmt.Errorf("toml can't represent %T", a)
+}
@@ -2,11 +2,29 @@ package main
 
 import (
 	"bytes"
-
-	"github.com/momiji/xqml"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 type XMLFormat struct {
+	Namespaces string            // "none" (just local names), "prefix" (soap:Body) or "uri" ({http://...}Body)
+	Convention string            // how elements map to values: "default", "badgerfish", "parker" or "gdata"
+	AttrPrefix *string           // overrides the convention's prefix for attribute keys
+	TextKey    *string           // overrides the convention's key for text
+	Root       string            // name of the root element, when one has to be made up
+	Item       string            // name of the items of a top level array
+	Items      map[string]string // names of the items of arrays, by path, like catalog.books=book
+	Singular   bool              // name the items of arrays after the singular of their key
+	ForceArray map[string]bool   // element names or paths which are always read as arrays
+	Arrays     bool              // read every child element as an array
 }
 
 func (f *XMLFormat) GetExtensions() []string {
@@ -28,31 +46,740 @@ func (f *XMLFormat) GetFeatures() FormatFeatures {
 		Can_scalar:      true,  // inserts a <root> element around it
 		Can_array:       false, // inserts a <root> element around it
 		Can_object:      true,  // if top level object has multiple keys, inserts a <root> element around it
+		Can_multidoc:    false,
 		Is_binary:       false,
 		Arbitrary_tree:  true,
 		Universal:       false, // tags are mapped cleanly; attributes and text can be handled in multiple ways
 	}
 }
 
+func (f *XMLFormat) AddFlags(fs *flag.FlagSet) {
+	fs.Func("xml-namespaces", "xml input and output: how to name things in namespaces: none (just the local name, like Body), prefix (as written, like soap:Body) or uri (like {http://schemas.xmlsoap.org/soap/envelope/}Body) (default none)", func(s string) error {
+		switch s {
+		case "none", "prefix", "uri":
+			f.Namespaces = s
+			return nil
+		}
+		return fmt.Errorf("expected none, prefix or uri")
+	})
+	fs.Func("xml-convention", "xml input and output: how elements map to values: default (@attr and #text), badgerfish (@attr and $), parker (no attributes, and no root element) or gdata (plain attributes and $t) (default default)", func(s string) error {
+		if _, ok := xml_conventions[s]; !ok {
+			return fmt.Errorf("expected default, badgerfish, parker or gdata")
+		}
+		f.Convention = s
+		return nil
+	})
+	fs.Func("xml-attr-prefix", "xml input and output: prefix for attribute keys, instead of the convention's (like @ or _)", func(s string) error {
+		f.AttrPrefix = &s
+		return nil
+	})
+	fs.Func("xml-force-array", "xml input: always read these elements as arrays, even when there's only one of them; names (like li) or dotted paths from the root (like html.body.ul.li)", func(s string) error {
+		if f.ForceArray == nil {
+			f.ForceArray = map[string]bool{}
+		}
+		for _, name := range strings.Split(s, ",") {
+			f.ForceArray[name] = true
+		}
+		return nil
+	})
+	fs.BoolVar(&f.Arrays, "xml-always-arrays", f.Arrays, "xml input: read every child element as an array, even when there's only one of them")
+	fs.StringVar(&f.Root, "xml-root", f.Root, "xml output: name of the root element, for arrays, scalars and objects with more than one key")
+	fs.StringVar(&f.Item, "xml-item", f.Item, "xml output: name of the items of a top level array")
+	fs.Func("xml-items", "xml output: put the items of the arrays at these paths inside one element, and give them this name, like catalog.books=book", func(s string) error {
+		if f.Items == nil {
+			f.Items = map[string]string{}
+		}
+		for _, decl := range strings.Split(s, ",") {
+			path, name, ok := strings.Cut(decl, "=")
+			if !ok || name == "" {
+				return fmt.Errorf("expected path=name, not %q", decl)
+			}
+			f.Items[path] = name
+		}
+		return nil
+	})
+	fs.BoolVar(&f.Singular, "xml-singular", f.Singular, "xml output: put the items of arrays inside one element, and name them after the singular of its name, like <items><item>")
+	fs.Func("xml-text-key", "xml input and output: key for the text of elements with attributes or children, instead of the convention's (like #text or _)", func(s string) error {
+		f.TextKey = &s
+		return nil
+	})
+}
+
+// An element, on its way between an xml document and a tree of values.
+type xmlElement struct {
+	name     string
+	attrs    []xmlAttr
+	children []*xmlElement
+	text     []string // the non-blank pieces of text directly inside it
+}
+
+type xmlAttr struct {
+	name  string
+	value string
+}
+
+// The namespace which the xml prefix is always bound to.
+const xml_namespace = "http://www.w3.org/XML/1998/namespace"
+
 func (f *XMLFormat) Input(in []byte) (any, error) {
-	b := bytes.NewBuffer(in)
-	dec := xqml.NewDecoder(b)
-	dec.Namespaces = false // maybe parameterize this
-	var data map[string]any
-	err := dec.Decode(&data)
-	return data, err
+	root, err := f.parse(in)
+	if err != nil {
+		return nil, err
+	}
+	c := f.convention()
+	if root == nil {
+		return map[string]any{}, nil
+	} else if !c.root {
+		return c.value(root, root.name), nil
+	}
+	return map[string]any{c.key(root.name): c.value(root, root.name)}, nil
+}
+
+// Reads a document into a tree of elements, and returns the root one.
+func (f *XMLFormat) parse(in []byte) (*xmlElement, error) {
+	dec := xml.NewDecoder(bytes.NewReader(in))
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+	next := dec.RawToken // leaves prefixes alone
+	if f.Namespaces == "uri" {
+		next = dec.Token // replaces them with the uris they stand for
+	}
+
+	var root *xmlElement
+	stack := []*xmlElement{}
+	for {
+		token, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			e := &xmlElement{name: f.name(token.Name)}
+			for _, attr := range token.Attr {
+				if name, ok := f.attr_name(attr.Name); ok {
+					e.attrs = append(e.attrs, xmlAttr{name, attr.Value})
+				}
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, e)
+			} else if root == nil {
+				root = e
+			} else {
+				return nil, fmt.Errorf("found <%s> after the root element <%s>", e.name, root.name)
+			}
+			stack = append(stack, e)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			text := strings.TrimSpace(string(token))
+			if text == "" {
+				continue
+			}
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("found text %q outside of the root element", text)
+			}
+			e := stack[len(stack)-1]
+			e.text = append(e.text, text)
+		}
+	}
+	return root, nil
+}
+
+// Names an element or attribute, according to --xml-namespaces.
+func (f *XMLFormat) name(n xml.Name) string {
+	switch {
+	case n.Space == "" || f.Namespaces == "none" || f.Namespaces == "":
+		return n.Local
+	case f.Namespaces == "uri":
+		return "{" + n.Space + "}" + n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+// Like name, for attributes.  Namespace declarations are kept along with the
+// namespaces, so they can be written out again.
+func (f *XMLFormat) attr_name(n xml.Name) (string, bool) {
+	switch {
+	case n.Space == "" && n.Local == "xmlns":
+		return "xmlns", f.Namespaces == "prefix" || f.Namespaces == "uri"
+	case n.Space == "xmlns":
+		return "xmlns:" + n.Local, f.Namespaces == "prefix" || f.Namespaces == "uri"
+	}
+	return f.name(n), true
+}
+
+// How elements map to values, and back.  This is what --xml-convention picks.
+type xmlConvention struct {
+	attrs      bool   // attributes are kept
+	attrPrefix string // put in front of attribute keys; if empty, scalars are attributes on output
+	textKey    string // key for text, next to attributes or children; if empty, it's dropped
+	objects    bool   // elements are always objects, even if they just hold text
+	root       bool   // the document is an object holding the root element, rather than its value
+	xmlnsKey   bool   // namespace declarations are gathered in an @xmlns object, by prefix ($ for the default)
+	nsSep      string // separates namespace prefixes from names, instead of :
+
+	namespaces string            // --xml-namespaces
+	rootName   string            // --xml-root
+	itemName   string            // --xml-item
+	itemNames  map[string]string // --xml-items
+	singular   bool              // --xml-singular
+
+	forceArray   map[string]bool // --xml-force-array
+	alwaysArrays bool            // --xml-always-arrays
+}
+
+var xml_conventions = map[string]xmlConvention{
+	"default":    {attrs: true, attrPrefix: "@", textKey: "#text", root: true},
+	"badgerfish": {attrs: true, attrPrefix: "@", textKey: "$", objects: true, root: true, xmlnsKey: true},
+	"parker":     {},
+	"gdata":      {attrs: true, textKey: "$t", objects: true, root: true, nsSep: "$"},
+}
+
+func (f *XMLFormat) convention() *xmlConvention {
+	c := xml_conventions["default"]
+	if conv, ok := xml_conventions[f.Convention]; ok {
+		c = conv
+	}
+	if f.AttrPrefix != nil {
+		c.attrPrefix = *f.AttrPrefix
+	}
+	if f.TextKey != nil {
+		c.textKey = *f.TextKey
+	}
+	c.namespaces = f.Namespaces
+	c.rootName = f.Root
+	c.itemName = f.Item
+	c.itemNames = f.Items
+	c.singular = f.Singular
+	c.forceArray = f.ForceArray
+	c.alwaysArrays = f.Arrays
+	return &c
+}
+
+// Turns the name of an element or attribute into a key.
+func (c *xmlConvention) key(name string) string {
+	if c.nsSep != "" && c.namespaces != "uri" {
+		return strings.Replace(name, ":", c.nsSep, 1)
+	}
+	return name
+}
+
+// The reverse of key.
+func (c *xmlConvention) name(key string) string {
+	if c.nsSep != "" && c.namespaces != "uri" {
+		return strings.Replace(key, c.nsSep, ":", 1)
+	}
+	return key
+}
+
+// Returns the attribute name which an object key stands for, if it does.
+func (c *xmlConvention) attribute(key string, value any) (string, bool) {
+	if !c.attrs || (c.textKey != "" && key == c.textKey) {
+		return "", false
+	}
+	if c.attrPrefix == "" {
+		switch value.(type) {
+		case map[string]any, []any:
+			return "", false
+		}
+		return key, true
+	}
+	return strings.CutPrefix(key, c.attrPrefix)
+}
+
+// Turns an element into a value.  Usually that's an object holding its
+// attributes, children (as arrays, if there are several with the same name)
+// and text, or just its text, if that's all it has.  path is the dotted names
+// of the elements down to this one, for --xml-force-array.
+func (c *xmlConvention) value(e *xmlElement, path string) any {
+	text := strings.Join(e.text, " ")
+	attrs := e.attrs
+	if !c.attrs {
+		attrs = nil
+	}
+	if len(attrs) == 0 && len(e.children) == 0 && !c.objects {
+		if text == "" {
+			return nil
+		}
+		return xml_cast(text)
+	}
+
+	obj := map[string]any{}
+	for _, attr := range attrs {
+		if c.xmlnsKey && (attr.name == "xmlns" || strings.HasPrefix(attr.name, "xmlns:")) {
+			xmlns, _ := obj[c.attrPrefix+"xmlns"].(map[string]any)
+			if xmlns == nil {
+				xmlns = map[string]any{}
+				obj[c.attrPrefix+"xmlns"] = xmlns
+			}
+			prefix, ok := strings.CutPrefix(attr.name, "xmlns:")
+			if !ok {
+				prefix = "$"
+			}
+			xmlns[prefix] = attr.value
+			continue
+		}
+		obj[c.attrPrefix+c.key(attr.name)] = attr.value
+	}
+	repeated := map[string]bool{}
+	for _, child := range e.children {
+		key := c.key(child.name)
+		childpath := path + "." + child.name
+		value := c.value(child, childpath)
+		existing, ok := obj[key]
+		switch {
+		case repeated[key]:
+			obj[key] = append(existing.([]any), value)
+		case ok:
+			obj[key] = []any{existing, value}
+			repeated[key] = true
+		case c.alwaysArrays || c.forceArray[child.name] || c.forceArray[childpath]:
+			obj[key] = []any{value}
+			repeated[key] = true
+		default:
+			obj[key] = value
+		}
+	}
+	if text != "" && c.textKey != "" {
+		obj[c.textKey] = xml_cast(text)
+	}
+	if len(obj) == 0 && !c.objects {
+		return nil // parker, with only attributes
+	}
+	return obj
+}
+
+var xml_number_re = regexp.MustCompile(`^[+-]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][+-]?[0-9]+)?$`)
+
+// Turns text which looks like a number or a boolean into one.
+func xml_cast(text string) any {
+	if n, ok := new(big.Int).SetString(text, 10); ok {
+		return big_int(n)
+	}
+	if xml_number_re.MatchString(text) {
+		if n, ok := parse_float(text); ok {
+			return n
+		}
+	}
+	switch text {
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	return text
 }
 
 func (f *XMLFormat) Output(a any, prettyprint bool) ([]byte, error) {
+	root, err := f.convention().document(a)
+	if err != nil {
+		return nil, err
+	}
 	b := bytes.NewBuffer([]byte{})
-	enc := xqml.NewEncoder(b)
+	enc := xml.NewEncoder(b)
 	if prettyprint {
-		indent := "  "
-		enc.Indent = indent
+		enc.Indent("", "  ")
+	}
+	if err := f.write(enc, root, map[string]string{"xml": xml_namespace}); err != nil {
+		return nil, err
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
 	}
-	err := enc.Encode(a)
 	if prettyprint {
 		b.WriteString("\n")
 	}
-	return b.Bytes(), err
+	return b.Bytes(), nil
+}
+
+// Works out the root element for a value.  An object with a single key
+// (which isn't an array) becomes that element; anything else goes inside a
+// <root> element (or --xml-root).
+func (c *xmlConvention) document(a any) (*xmlElement, error) {
+	if obj, ok := a.(map[string]any); ok && len(obj) == 1 && c.root {
+		for key, value := range obj {
+			_, isarray := value.([]any)
+			_, isattr := c.attribute(key, value)
+			if !isarray && !isattr && key != c.textKey {
+				return c.element(c.name(key), value, c.name(key))
+			}
+		}
+	}
+	if arr, ok := a.([]any); ok {
+		root := &xmlElement{name: c.rootName}
+		item := c.item(c.rootName, c.rootName)
+		if item == "" {
+			item = c.itemName
+		}
+		err := c.items(root, item, arr, c.rootName+"."+item)
+		return root, err
+	}
+	return c.element(c.rootName, a, c.rootName)
+}
+
+// Like element, but an array becomes several elements with the same name, or
+// one element holding an element for each item, if the items have a name of
+// their own.  path is the dotted names of the elements down to here.
+func (c *xmlConvention) elements(name string, value any, path string) ([]*xmlElement, error) {
+	arr, ok := value.([]any)
+	if !ok {
+		e, err := c.element(name, value, path)
+		return []*xmlElement{e}, err
+	}
+	if item := c.item(name, path); item != "" {
+		e := &xmlElement{name: name}
+		err := c.items(e, item, arr, path+"."+item)
+		return []*xmlElement{e}, err
+	}
+	rv := []*xmlElement{}
+	for _, item := range arr {
+		children, err := c.elements(name, item, path)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, children...)
+	}
+	return rv, nil
+}
+
+// Adds the items of an array to an element, each one named name.
+func (c *xmlConvention) items(e *xmlElement, name string, arr []any, path string) error {
+	for _, item := range arr {
+		children, err := c.elements(name, item, path)
+		if err != nil {
+			return err
+		}
+		e.children = append(e.children, children...)
+	}
+	return nil
+}
+
+// Returns the name for the items of an array, from --xml-items or
+// --xml-singular, or "" if they're just repeated elements.
+func (c *xmlConvention) item(name, path string) string {
+	if item, ok := c.itemNames[path]; ok {
+		return item
+	}
+	if c.singular {
+		if item := xml_singular(name); item != name {
+			return item
+		}
+	}
+	return ""
+}
+
+// Irregular plurals, for xml_singular.
+var xml_singulars = map[string]string{
+	"children": "child",
+	"people":   "person",
+	"men":      "man",
+	"women":    "woman",
+	"feet":     "foot",
+	"teeth":    "tooth",
+	"mice":     "mouse",
+	"geese":    "goose",
+	"indices":  "index",
+	"matrices": "matrix",
+	"vertices": "vertex",
+	"criteria": "criterion",
+	"data":     "datum",
+}
+
+// Guesses the singular of an english plural, like items -> item.  Returns
+// the name unchanged if it doesn't look like a plural.
+func xml_singular(name string) string {
+	prefix, word := "", name
+	if i := strings.LastIndexAny(name, ":}"); i >= 0 {
+		prefix, word = name[:i+1], name[i+1:] // leave the namespace alone
+	}
+	lower := strings.ToLower(word)
+	if singular, ok := xml_singulars[lower]; ok {
+		if lower != word {
+			return name // Children, CHILDREN: not worth guessing
+		}
+		return prefix + singular
+	}
+	n := len(word)
+	switch {
+	case n > 4 && strings.HasSuffix(lower, "ies"):
+		return prefix + word[:n-3] + "y"
+	case strings.HasSuffix(lower, "sses"), strings.HasSuffix(lower, "shes"), strings.HasSuffix(lower, "ches"),
+		strings.HasSuffix(lower, "xes"), strings.HasSuffix(lower, "zzes"):
+		return prefix + word[:n-2]
+	case strings.HasSuffix(lower, "ss"), strings.HasSuffix(lower, "us"), strings.HasSuffix(lower, "is"):
+		return name
+	case n > 1 && strings.HasSuffix(lower, "s"):
+		return prefix + word[:n-1]
+	}
+	return name
+}
+
+// The reverse of value: turns one value into an element.
+func (c *xmlConvention) element(name string, value any, path string) (*xmlElement, error) {
+	e := &xmlElement{name: name}
+	obj, ok := value.(map[string]any)
+	if !ok {
+		text, err := xml_text(value)
+		if err != nil {
+			return nil, fmt.Errorf("xml cannot represent <%s>: %w", name, err)
+		}
+		if text != "" {
+			e.text = []string{text}
+		}
+		return e, nil
+	}
+	for _, key := range sorted_keys(obj) {
+		child := obj[key]
+		if key == c.textKey && c.textKey != "" {
+			text, err := xml_text(child)
+			if err != nil {
+				return nil, fmt.Errorf("xml cannot represent the text of <%s>: %w", name, err)
+			}
+			if text != "" {
+				e.text = []string{text}
+			}
+		} else if attr, ok := c.attribute(key, child); ok {
+			if xmlns, ok := child.(map[string]any); ok && c.xmlnsKey && attr == "xmlns" {
+				for _, prefix := range sorted_keys(xmlns) {
+					text, err := xml_text(xmlns[prefix])
+					if err != nil {
+						return nil, fmt.Errorf("xml cannot represent the namespace %q of <%s>: %w", prefix, name, err)
+					}
+					if prefix == "$" {
+						e.attrs = append(e.attrs, xmlAttr{"xmlns", text})
+					} else {
+						e.attrs = append(e.attrs, xmlAttr{"xmlns:" + prefix, text})
+					}
+				}
+				continue
+			}
+			text, err := xml_text(child)
+			if err != nil {
+				return nil, fmt.Errorf("xml cannot represent the %s attribute of <%s>: %w", key, name, err)
+			}
+			e.attrs = append(e.attrs, xmlAttr{c.name(attr), text})
+		} else {
+			children, err := c.elements(c.name(key), child, path+"."+c.name(key))
+			if err != nil {
+				return nil, err
+			}
+			e.children = append(e.children, children...)
+		}
+	}
+	return e, nil
+}
+
+// Formats a scalar value as text, for an attribute or the inside of an
+// element.
+func xml_text(value any) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case int:
+		return strconv.Itoa(value), nil
+	case float64:
+		if math.Abs(value) < 1e21 {
+			return strconv.FormatFloat(value, 'f', -1, 64), nil
+		}
+		return strconv.FormatFloat(value, 'g', -1, 64), nil
+	case *big.Int:
+		return value.String(), nil
+	case map[string]any, []any:
+		return "", fmt.Errorf("expected a scalar value, not %T", value)
+	case stringable:
+		return value.String(), nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// Writes an element and everything inside it.  scope holds the namespaces
+// declared so far, by prefix, for --xml-namespaces uri.
+func (f *XMLFormat) write(enc *xml.Encoder, e *xmlElement, scope map[string]string) error {
+	start := xml.StartElement{Name: xml.Name{Local: e.name}}
+	if f.Namespaces == "uri" {
+		start.Name.Local, start.Attr, scope = f.qualify(e, scope)
+	} else {
+		for _, attr := range e.attrs {
+			start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: attr.name}, Value: attr.value})
+		}
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if len(e.text) > 0 {
+		if err := enc.EncodeToken(xml.CharData(strings.Join(e.text, " "))); err != nil {
+			return err
+		}
+	}
+	for _, child := range e.children {
+		if err := f.write(enc, child, scope); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// Turns {uri}name names back into prefix:name ones, using the prefixes which
+// are declared in scope, or declaring new ones.  Returns the element's name,
+// its attributes, and the scope for its children.
+func (f *XMLFormat) qualify(e *xmlElement, outer map[string]string) (string, []xml.Attr, map[string]string) {
+	scope := map[string]string{}
+	for prefix, uri := range outer {
+		scope[prefix] = uri
+	}
+	for _, attr := range e.attrs {
+		if attr.name == "xmlns" {
+			scope[""] = attr.value
+		} else if prefix, ok := strings.CutPrefix(attr.name, "xmlns:"); ok {
+			scope[prefix] = attr.value
+		}
+	}
+
+	attrs := []xml.Attr{}
+	prefixed := func(name string, isattr bool) string {
+		if !strings.HasPrefix(name, "{") || !strings.Contains(name, "}") {
+			return name
+		}
+		uri, local, _ := strings.Cut(name[1:], "}")
+		prefixes := []string{}
+		for prefix := range scope {
+			prefixes = append(prefixes, prefix)
+		}
+		sort.Strings(prefixes)
+		for _, prefix := range prefixes {
+			if scope[prefix] != uri || (isattr && prefix == "") {
+				continue // attributes don't go in the default namespace
+			}
+			if prefix == "" {
+				return local
+			}
+			return prefix + ":" + local
+		}
+		for i := 1; ; i++ {
+			prefix := fmt.Sprintf("ns%d", i)
+			if _, taken := scope[prefix]; !taken {
+				scope[prefix] = uri
+				attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "xmlns:" + prefix}, Value: uri})
+				return prefix + ":" + local
+			}
+		}
+	}
+	name := prefixed(e.name, false)
+	for _, attr := range e.attrs {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: prefixed(attr.name, true)}, Value: attr.value})
+	}
+	return name, attrs, scope
+}
+
+// Parts of an xml document which run until a terminator, and how to color
+// them.
+var xml_color_spans = []struct {
+	start, end string
+	comment    bool
+}{
+	{"<!--", "-->", true},
+	{"<![CDATA[", "]]>", false},
+	{"<?", "?>", true},
+	{"<!", ">", true},
+}
+
+func (f *XMLFormat) Colorize(b []byte, c *Colors) []byte {
+	w := bytes.NewBuffer(make([]byte, 0, 2*len(b)))
+	for len(b) > 0 {
+		n := 0
+		if b[0] != '<' {
+			// text, up to the next tag
+			n = bytes.IndexByte(b, '<')
+			if n < 0 {
+				n = len(b)
+			}
+			lead := len(b[:n]) - len(bytes.TrimLeft(b[:n], " \t\r\n"))
+			text := bytes.TrimRight(b[lead:n], " \t\r\n")
+			w.Write(b[:lead])
+			c.paint(w, c.String, text)
+			w.Write(b[lead+len(text) : n])
+		} else if n = xml_color_span(w, c, b); n == 0 {
+			n = xml_color_tag(w, c, b)
+		}
+		b = b[n:]
+	}
+	return w.Bytes()
+}
+
+// Colors a comment, CDATA section, processing instruction or declaration, if
+// b starts with one, and returns its length.
+func xml_color_span(w *bytes.Buffer, c *Colors, b []byte) int {
+	for _, span := range xml_color_spans {
+		if !bytes.HasPrefix(b, []byte(span.start)) {
+			continue
+		}
+		n := bytes.Index(b[len(span.start):], []byte(span.end))
+		if n < 0 {
+			n = len(b)
+		} else {
+			n += len(span.start) + len(span.end)
+		}
+		sgr := c.String
+		if span.comment {
+			sgr = c.Null
+		}
+		c.paint(w, sgr, b[:n])
+		return n
+	}
+	return 0
+}
+
+// Colors the element tag at the start of b, with its attributes, and returns
+// its length.
+func xml_color_tag(w *bytes.Buffer, c *Colors, b []byte) int {
+	n := bytes.IndexAny(b[1:], " \t\r\n/>") + 1
+	if n == 0 {
+		n = len(b)
+	} else if n == 1 && b[1] == '/' {
+		// a closing tag
+		n = bytes.IndexAny(b[2:], " \t\r\n>") + 2
+		if n == 1 {
+			n = len(b)
+		}
+	}
+	c.paint(w, c.Object, b[:n])
+	for n < len(b) {
+		switch ch := b[n]; {
+		case ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n':
+			w.WriteByte(ch)
+			n++
+		case ch == '>':
+			c.paint(w, c.Object, b[n:n+1])
+			return n + 1
+		case bytes.HasPrefix(b[n:], []byte("/>")):
+			c.paint(w, c.Object, b[n:n+2])
+			return n + 2
+		case ch == '=' || ch == '/':
+			c.paint(w, c.Object, b[n:n+1])
+			n++
+		case ch == '"' || ch == '\'':
+			end := n + quoted_len(b[n:], string(ch), false)
+			c.paint(w, c.String, b[n:end])
+			n = end
+		default:
+			end := bytes.IndexAny(b[n:], " \t\r\n=/>\"'")
+			if end < 0 {
+				end = len(b)
+			} else {
+				end += n
+			}
+			c.paint(w, c.Key, b[n:end])
+			n = end
+		}
+	}
+	return n
 }
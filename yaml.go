@@ -1,6 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
 	yaml "gopkg.in/yaml.v3"
 )
 
@@ -22,19 +31,719 @@ func (f *YAMLFormat) GetFeatures() FormatFeatures {
 		Can_scalar:      true,
 		Can_array:       true,
 		Can_object:      true,
+		Can_multidoc:    true,
 		Is_binary:       false,
 		Arbitrary_tree:  true,
 		Universal:       true,
 	}
 }
 
+func (f *YAMLFormat) NativeTypes() NativeTypes {
+	return NativeTypes{Dates: true, Binary: true}
+}
+
 func (f *YAMLFormat) Input(b []byte) (any, error) {
-	var data any
-	err := yaml.Unmarshal(b, &data)
-	return data, err
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	return yaml_value(&doc)
 }
 
 func (f *YAMLFormat) Output(a any, _ bool) ([]byte, error) {
-	rv, err := yaml.Marshal(a)
-	return rv, err
+	a, err := yaml_scalars(a)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(a)
+}
+
+func (f *YAMLFormat) Separator() []byte {
+	return []byte("---\n")
+}
+
+func (f *YAMLFormat) NewDecoder(r io.Reader) DocumentDecoder {
+	dec := yaml.NewDecoder(r)
+	return decoderFunc(func() (any, error) {
+		var doc yaml.Node
+		if err := dec.Decode(&doc); err != nil {
+			return nil, err
+		}
+		return yaml_value(&doc)
+	})
+}
+
+var yaml_int_re = regexp.MustCompile(`^[-+]?[0-9]+$`)
+
+// Decodes a node the way yaml.v3 would decode it into an any, except that
+// integers which are too big for it keep all of their digits, rather than
+// turning into floats, and binary data stays binary.
+func yaml_value(node *yaml.Node) (any, error) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return yaml_value(node.Content[0])
+	case yaml.AliasNode:
+		return yaml_value(node.Alias)
+	case yaml.SequenceNode:
+		arr := make([]any, len(node.Content))
+		for i, child := range node.Content {
+			value, err := yaml_value(child)
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = value
+		}
+		return arr, nil
+	case yaml.MappingNode:
+		obj := map[string]any{}
+		merged := map[string]any{} // from << keys, which the others override
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keynode, valuenode := node.Content[i], node.Content[i+1]
+			if keynode.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: only scalar keys are supported", keynode.Line)
+			}
+			value, err := yaml_value(valuenode)
+			if err != nil {
+				return nil, err
+			}
+			if keynode.ShortTag() != "!!merge" {
+				obj[keynode.Value] = value
+				continue
+			}
+			sources, ok := value.([]any)
+			if !ok {
+				sources = []any{value}
+			}
+			for _, source := range sources {
+				source, ok := source.(map[string]any)
+				if !ok {
+					return nil, fmt.Errorf("line %d: merge keys need a map, or a list of maps", keynode.Line)
+				}
+				for key, value := range source {
+					if _, ok := merged[key]; !ok {
+						merged[key] = value // earlier ones win
+					}
+				}
+			}
+		}
+		for key, value := range merged {
+			if _, ok := obj[key]; !ok {
+				obj[key] = value
+			}
+		}
+		return obj, nil
+	}
+	if node.ShortTag() == "!!binary" {
+		return base64.StdEncoding.DecodeString(node.Value)
+	}
+	var value any
+	err := node.Decode(&value)
+	if _, isfloat := value.(float64); (err != nil || isfloat) && yaml_int_re.MatchString(node.Value) {
+		if n, ok := new(big.Int).SetString(node.Value, 10); ok {
+			return big_int(n), nil
+		}
+	}
+	return value, err
+}
+
+// Replaces big integers and binary data with nodes, since yaml.v3 would write
+// them as a string and a list of numbers.
+func yaml_scalars(a any) (any, error) {
+	return map_scalars(a, func(v any) (any, error) {
+		switch v := v.(type) {
+		case *big.Int:
+			return &yaml.Node{Kind: yaml.ScalarNode, Value: v.String()}, nil
+		case []byte:
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!binary", Value: base64.StdEncoding.EncodeToString(v)}, nil
+		}
+		return v, nil
+	})
+}
+
+func (f *YAMLFormat) Patch(orig []byte, a any, _ bool) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(orig, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		// nothing to preserve
+		return f.Output(a, false)
+	}
+	p := &yamlPatcher{orig: orig, lines: []int{0}, unit: yaml_indent(orig), native: f.NativeTypes(), touched: map[*yaml.Node]bool{}}
+	for i, c := range orig {
+		if c == '\n' {
+			p.lines = append(p.lines, i+1)
+		}
+	}
+	root := doc.Content[0]
+	slot := yamlSlot{start: p.offset(root), end: p.end(root, -1), indent: -1}
+	if err := p.patch(root, a, slot); err != nil {
+		return nil, err
+	}
+	return apply_edits(orig, p.edits), nil
+}
+
+// Rewrites the parts of a yaml document which changed, like the toml and ini
+// Patch do, by finding where each node is in the original text.  yaml.v3 only
+// says where nodes start, so the rest is worked out here.
+type yamlPatcher struct {
+	orig    []byte
+	lines   []int // offset of the start of each line
+	unit    int   // indentation for new nested values
+	native  NativeTypes
+	edits   []textEdit
+	touched map[*yaml.Node]bool // nodes which were edited, so aliases to them are out of date
+}
+
+// Where a node sits in the document, for replacing it with something else.
+type yamlSlot struct {
+	start  int  // just after the : or - before the node, or where the node starts, at the top level
+	end    int  // where the node ends
+	indent int  // column of the key or - before the node, or -1 at the top level
+	kind   byte // ':', '-', or 0 at the top level
+}
+
+// Adds the edits which make node hold value, which is normalized, like
+// everything gojq returns.  Parts of the tree which already
+// hold the right thing are left alone, along with their comments and layout.
+func (p *yamlPatcher) patch(node *yaml.Node, value any, slot yamlSlot) error {
+	old, err := yaml_value(node)
+	old = normalize(old)
+	if err == nil && same_value(old, value) && !p.stale(node) {
+		return nil
+	}
+	p.touched[node] = true
+	if node.Style&yaml.FlowStyle == 0 {
+		switch node.Kind {
+		case yaml.MappingNode:
+			oldobj, _ := old.(map[string]any)
+			if obj, ok := value.(map[string]any); ok && len(obj) > 0 {
+				if ok, err := p.patch_mapping(node, obj, oldobj); ok || err != nil {
+					return err
+				}
+			}
+		case yaml.SequenceNode:
+			if arr, ok := value.([]any); ok && len(arr) > 0 {
+				if ok, err := p.patch_sequence(node, arr); ok || err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return p.replace(node, value, slot)
+}
+
+// Patches each key of a block mapping.  Returns false if it can't be done
+// piece by piece, so the whole mapping should be replaced.
+func (p *yamlPatcher) patch_mapping(node *yaml.Node, obj, old map[string]any) (bool, error) {
+	type entry struct {
+		key, value *yaml.Node
+		start      int // of the key
+		colon      int
+	}
+	entries := []entry{}
+	own := map[string]bool{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.Kind != yaml.ScalarNode || own[key.Value] {
+			return false, nil
+		}
+		start := p.offset(key)
+		colon := p.end(key, -1)
+		for colon < len(p.orig) && (p.orig[colon] == ' ' || p.orig[colon] == '\t') {
+			colon++
+		}
+		if colon >= len(p.orig) || p.orig[colon] != ':' {
+			return false, nil // like a "? key" with the value on the next line
+		}
+		if key.ShortTag() == "!!merge" {
+			if p.stale(value) {
+				return false, nil // the merged values changed underneath it
+			}
+			continue
+		}
+		if _, ok := obj[key.Value]; !ok && !p.starts_line(start) {
+			return false, nil // the first key of a "- key: value" item
+		}
+		own[key.Value] = true
+		entries = append(entries, entry{key, value, start, colon})
+	}
+	for key := range old {
+		if _, ok := obj[key]; !ok && !own[key] {
+			return false, nil // it came from a merge key, so it can't just be removed
+		}
+	}
+
+	if len(entries) == 0 {
+		return false, nil
+	}
+	indent := p.column(entries[0].start)
+	for _, e := range entries {
+		end := p.end(e.value, indent)
+		value, ok := obj[e.key.Value]
+		if !ok {
+			p.edits = append(p.edits, textEdit{line_start(p.orig, e.start), line_end(p.orig, end), ""})
+			continue
+		}
+		if err := p.patch(e.value, value, yamlSlot{start: e.colon + 1, end: end, indent: indent, kind: ':'}); err != nil {
+			return false, err
+		}
+	}
+	insert := line_end(p.orig, p.end(node, indent))
+	for _, key := range sorted_keys(obj) {
+		if oldvalue, ok := old[key]; own[key] || ok && same_value(oldvalue, obj[key]) {
+			continue // already there, or merged in from elsewhere
+		}
+		keytext, err := p.render(0, key, nil, indent)
+		if err != nil {
+			return false, err
+		}
+		text, err := p.render(':', obj[key], nil, indent)
+		if err != nil {
+			return false, fmt.Errorf("yaml cannot represent the value at %q: %w", key, err)
+		}
+		text = strings.Repeat(" ", indent) + keytext + ":" + text + "\n"
+		p.edits = append(p.edits, textEdit{insert, insert, text})
+	}
+	return true, nil
+}
+
+// Patches each item of a block sequence, and adds or removes them at the end.
+// Returns false if the whole sequence should be replaced instead.
+func (p *yamlPatcher) patch_sequence(node *yaml.Node, arr []any) (bool, error) {
+	dashes := make([]int, len(node.Content))
+	for i, item := range node.Content {
+		dashes[i] = p.offset(item) - 1
+		for dashes[i] > 0 && strings.ContainsRune(" \t\r\n", rune(p.orig[dashes[i]])) {
+			dashes[i]--
+		}
+		if dashes[i] < 0 || p.orig[dashes[i]] != '-' {
+			return false, nil
+		}
+	}
+	if len(arr) < len(dashes) && !p.starts_line(dashes[len(arr)]) {
+		return false, nil
+	}
+
+	indent := p.column(dashes[0])
+	end := p.end(node, indent)
+	for i, item := range node.Content {
+		if i >= len(arr) {
+			p.edits = append(p.edits, textEdit{line_start(p.orig, dashes[i]), line_end(p.orig, end), ""})
+			break
+		}
+		slot := yamlSlot{start: dashes[i] + 1, end: p.end(item, indent), indent: indent, kind: '-'}
+		if err := p.patch(item, arr[i], slot); err != nil {
+			return false, err
+		}
+	}
+	for i := len(node.Content); i < len(arr); i++ {
+		text, err := p.render('-', arr[i], nil, indent)
+		if err != nil {
+			return false, fmt.Errorf("yaml cannot represent the value at [%d]: %w", i, err)
+		}
+		text = strings.Repeat(" ", indent) + "-" + text + "\n"
+		insert := line_end(p.orig, end)
+		p.edits = append(p.edits, textEdit{insert, insert, text})
+	}
+	return true, nil
+}
+
+// Replaces node outright.
+func (p *yamlPatcher) replace(node *yaml.Node, value any, slot yamlSlot) error {
+	text, err := p.render(slot.kind, value, node, slot.indent)
+	if err != nil {
+		return err
+	}
+	start := p.offset(node)
+	if slot.kind != 0 && strings.HasPrefix(text, " ") && !strings.Contains(text, "\n") && start < slot.end && !bytes.Contains(p.orig[slot.start:start], []byte("\n")) {
+		// on the same line as before, so keep the spacing in front of it
+		p.edits = append(p.edits, textEdit{start, slot.end, text[1:]})
+		return nil
+	}
+	p.edits = append(p.edits, textEdit{slot.start, slot.end, text})
+	return nil
+}
+
+// Returns whether node holds an alias to something which was edited, so it
+// no longer holds the same value, even if it looks the same.
+func (p *yamlPatcher) stale(node *yaml.Node) bool {
+	if len(p.touched) == 0 {
+		return false
+	}
+	if node.Kind == yaml.AliasNode {
+		return p.touched[node.Alias]
+	}
+	for _, child := range node.Content {
+		if p.stale(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// Formats value for writing after a "key:" or "-" at column indent, starting
+// with a space, or with a newline for block mappings and sequences.  With
+// kind 0, it's formatted on its own, as a key or a whole document.  like is
+// the node it replaces, if any, whose quoting and flow style it keeps.
+func (p *yamlPatcher) render(kind byte, value any, like *yaml.Node, indent int) (string, error) {
+	node, err := yaml_new_node(denormalize(value, p.native))
+	if err != nil {
+		return "", err
+	}
+	if like != nil && like.Kind == node.Kind {
+		if node.Kind != yaml.ScalarNode {
+			node.Style |= like.Style & yaml.FlowStyle
+		} else if node.ShortTag() == "!!str" && like.ShortTag() == "!!str" {
+			node.Style = like.Style & (yaml.DoubleQuotedStyle | yaml.SingleQuotedStyle)
+			if strings.Contains(node.Value, "\n") {
+				node.Style |= like.Style & (yaml.LiteralStyle | yaml.FoldedStyle)
+			}
+		}
+	}
+	wrapper := node
+	switch kind {
+	case ':':
+		wrapper = &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{{Kind: yaml.ScalarNode, Value: "k"}, node}}
+	case '-':
+		wrapper = &yaml.Node{Kind: yaml.SequenceNode, Content: []*yaml.Node{node}}
+	}
+	b := bytes.NewBuffer([]byte{})
+	enc := yaml.NewEncoder(b)
+	enc.SetIndent(p.unit)
+	if err := enc.Encode(wrapper); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	text := strings.TrimSuffix(b.String(), "\n")
+	switch kind {
+	case ':':
+		text = strings.TrimPrefix(text, "k:")
+	case '-':
+		text = strings.TrimPrefix(text, "-")
+	}
+	lines := strings.Split(text, "\n")
+	for i := 1; i < len(lines); i++ {
+		if lines[i] != "" && indent > 0 {
+			lines[i] = strings.Repeat(" ", indent) + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// Returns the offset of the start of node.  Columns count characters, not
+// bytes.
+func (p *yamlPatcher) offset(node *yaml.Node) int {
+	if node.Line < 1 || node.Line > len(p.lines) {
+		return len(p.orig)
+	}
+	pos := p.lines[node.Line-1]
+	for col := 1; col < node.Column && pos < len(p.orig); col++ {
+		_, size := utf8.DecodeRune(p.orig[pos:])
+		pos += size
+	}
+	return pos
+}
+
+// Returns the column of offset pos, for indentation, which is all spaces.
+func (p *yamlPatcher) column(pos int) int {
+	return pos - line_start(p.orig, pos)
+}
+
+// Returns whether there's nothing but indentation before offset pos on its line.
+func (p *yamlPatcher) starts_line(pos int) bool {
+	return len(bytes.TrimLeft(p.orig[line_start(p.orig, pos):pos], " ")) == 0
+}
+
+// Returns the offset just past the end of node, not counting any comment
+// after it.  indent is the column of the key or - in front of it, which block
+// scalars and plain scalars over several lines are indented further than.
+func (p *yamlPatcher) end(node *yaml.Node, indent int) int {
+	orig := p.orig
+	pos := p.offset(node)
+	switch node.Kind {
+	case yaml.AliasNode:
+		return pos + 1 + len(node.Value)
+	case yaml.MappingNode, yaml.SequenceNode:
+		if node.Style&yaml.FlowStyle == 0 && len(node.Content) > 0 {
+			last := node.Content[len(node.Content)-1]
+			if node.Kind == yaml.MappingNode {
+				return p.end(last, p.column(p.offset(node.Content[0])))
+			}
+			dash := p.offset(last) - 1
+			for dash > 0 && orig[dash] != '-' {
+				dash--
+			}
+			return p.end(last, p.column(dash))
+		}
+	}
+
+	// skip over any anchor and tag
+	for pos < len(orig) && (orig[pos] == '&' || orig[pos] == '!') {
+		for pos < len(orig) && !strings.ContainsRune(" \t\r\n", rune(orig[pos])) {
+			pos++
+		}
+		for pos < len(orig) && strings.ContainsRune(" \t\r\n", rune(orig[pos])) {
+			pos++
+		}
+	}
+	if pos >= len(orig) {
+		return len(orig)
+	}
+
+	switch {
+	case node.Kind != yaml.ScalarNode:
+		// a flow mapping or sequence, so find the bracket which closes it
+		depth := 0
+		for i := pos; i < len(orig); i++ {
+			switch orig[i] {
+			case '"', '\'':
+				i += quoted_len(orig[i:], string(orig[i]), orig[i] == '"') - 1
+			case '#':
+				if i > 0 && strings.ContainsRune(" \t\r\n", rune(orig[i-1])) {
+					i = line_end(orig, i) - 1
+				}
+			case '[', '{':
+				depth++
+			case ']', '}':
+				if depth--; depth == 0 {
+					return i + 1
+				}
+			}
+		}
+		return len(orig)
+	case node.Style&yaml.DoubleQuotedStyle != 0:
+		return pos + quoted_len(orig[pos:], `"`, true)
+	case node.Style&yaml.SingleQuotedStyle != 0:
+		for {
+			// '' is an escaped quote, so carry on after it
+			pos += quoted_len(orig[pos:], "'", false)
+			if pos >= len(orig) || orig[pos] != '\'' {
+				return pos
+			}
+		}
+	case node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0:
+		end := pos
+		for end < len(orig) && !strings.ContainsRune(" \t\r\n", rune(orig[end])) {
+			end++ // the | or > header
+		}
+		for i := line_end(orig, pos); i < len(orig); i = line_end(orig, i) {
+			line := bytes.TrimRight(orig[i:line_end(orig, i)], " \t\r\n")
+			if len(line) == 0 {
+				continue
+			}
+			if len(line)-len(bytes.TrimLeft(line, " ")) <= indent {
+				break
+			}
+			end = i + len(line)
+		}
+		return end
+	}
+
+	// a plain scalar, which ends at a comment, or a ": " if it's a key, and
+	// might go on over more indented lines
+	end := p.plain_end(pos)
+	if string(orig[pos:end]) == node.Value {
+		return end
+	}
+	for i := line_end(orig, pos); i < len(orig); i = line_end(orig, i) {
+		line := bytes.TrimRight(orig[i:line_end(orig, i)], " \t\r\n")
+		trimmed := bytes.TrimLeft(line, " ")
+		if len(trimmed) == 0 {
+			continue
+		}
+		if len(line)-len(trimmed) <= indent || trimmed[0] == '#' {
+			break
+		}
+		end = p.plain_end(i + len(line) - len(trimmed))
+	}
+	return end
+}
+
+// Returns the end of the part of a plain scalar on the line starting at pos.
+func (p *yamlPatcher) plain_end(pos int) int {
+	end := pos
+	for i := pos; i < len(p.orig) && p.orig[i] != '\n'; i++ {
+		c := p.orig[i]
+		if c == '#' && i > pos && (p.orig[i-1] == ' ' || p.orig[i-1] == '\t') {
+			break
+		}
+		if c == ':' && (i+1 == len(p.orig) || strings.ContainsRune(" \t\r\n", rune(p.orig[i+1]))) {
+			break
+		}
+		if c != ' ' && c != '\t' && c != '\r' {
+			end = i + 1
+		}
+	}
+	return end
+}
+
+func yaml_new_node(value any) (*yaml.Node, error) {
+	value, err := yaml_scalars(value)
+	if err != nil {
+		return nil, err
+	}
+	node := &yaml.Node{}
+	err = node.Encode(value)
+	return node, err
+}
+
+// Guesses the indentation of an existing document, so the rewritten one looks
+// the same.  Falls back to yaml.Marshal's default.
+func yaml_indent(b []byte) int {
+	indent := 0
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		trimmed := bytes.TrimLeft(line, " ")
+		if len(trimmed) == 0 || trimmed[0] == '#' {
+			continue
+		}
+		n := len(line) - len(trimmed)
+		if n > 0 && (indent == 0 || n < indent) {
+			indent = n
+		}
+	}
+	if indent < 2 || indent > 8 {
+		return 4
+	}
+	return indent
+}
+
+var yaml_key_re = regexp.MustCompile(`^("(?:[^"\\]|\\.)*"|'(?:[^']|'')*'|[^\s"'\[\]{}#&*!|>%@` + "`" + `][^#]*?)(\s*:)(?:\s|$)`)
+
+func (f *YAMLFormat) Colorize(b []byte, c *Colors) []byte {
+	w := bytes.NewBuffer(make([]byte, 0, 2*len(b)))
+	block_indent := -1 // inside a block scalar, which is indented more than this
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		body := bytes.TrimRight(line, "\r\n")
+		eol := line[len(body):]
+		indent := len(body) - len(bytes.TrimLeft(body, " "))
+		if block_indent >= 0 {
+			if len(bytes.TrimSpace(body)) == 0 || indent > block_indent {
+				c.paint(w, c.String, body)
+				w.Write(eol)
+				continue
+			}
+			block_indent = -1
+		}
+
+		w.Write(body[:indent])
+		rest := body[indent:]
+		switch {
+		case bytes.Equal(rest, []byte("---")) || bytes.Equal(rest, []byte("...")) || bytes.HasPrefix(rest, []byte("--- ")):
+			c.paint(w, c.Object, rest)
+			w.Write(eol)
+			continue
+		case bytes.HasPrefix(rest, []byte("#")) || bytes.HasPrefix(rest, []byte("%")):
+			c.paint(w, c.Null, rest)
+			w.Write(eol)
+			continue
+		}
+
+		// "- " sequence entries, maybe several on one line
+		col := indent
+		node := indent // where the innermost node on this line starts
+		for bytes.HasPrefix(rest, []byte("- ")) || bytes.Equal(rest, []byte("-")) {
+			node = col
+			c.paint(w, c.Array, rest[:1])
+			n := len(rest) - len(bytes.TrimLeft(rest[1:], " "))
+			w.Write(rest[1:n])
+			col += n
+			rest = rest[n:]
+		}
+		if m := yaml_key_re.FindSubmatchIndex(rest); m != nil {
+			node = col
+			c.paint(w, c.Key, rest[m[2]:m[3]])
+			c.paint(w, c.Object, rest[m[4]:m[5]])
+			rest = rest[m[5]:]
+		}
+		if yaml_color_value(w, c, rest) {
+			block_indent = node
+		}
+		w.Write(eol)
+	}
+	return w.Bytes()
+}
+
+// Colors the value part of a line.  Returns true if it starts a block scalar,
+// so the lines after it are part of the same string.
+func yaml_color_value(w *bytes.Buffer, c *Colors, b []byte) bool {
+	depth := 0 // inside a flow collection
+	for len(b) > 0 {
+		n := 0
+		switch ch := b[0]; {
+		case ch == ' ' || ch == '\t':
+			w.WriteByte(ch)
+			b = b[1:]
+			continue
+		case ch == '#':
+			c.paint(w, c.Null, b)
+			return false
+		case (ch == '|' || ch == '>') && depth == 0:
+			n = bytes.IndexAny(b, " \t")
+			if n < 0 {
+				n = len(b)
+			}
+			c.paint(w, c.Object, b[:n])
+			b = b[n:]
+			yaml_color_value(w, c, b) // a comment, probably
+			return true
+		case ch == '&' || ch == '!' || ch == '*':
+			n = bytes.IndexAny(b, " \t,[]{}")
+			if n < 0 {
+				n = len(b)
+			}
+			c.paint(w, c.Object, b[:n])
+		case ch == '[' || ch == ']' || ch == '{' || ch == '}':
+			if ch == '[' || ch == '{' {
+				depth++
+			} else {
+				depth--
+			}
+			n = 1
+			sgr := c.Array
+			if ch == '{' || ch == '}' {
+				sgr = c.Object
+			}
+			c.paint(w, sgr, b[:n])
+		case (ch == ',' || ch == ':') && depth > 0:
+			n = 1
+			c.paint(w, c.Object, b[:n])
+		default:
+			if ch == '"' || ch == '\'' {
+				n = quoted_len(b, string(ch), ch == '"')
+			} else {
+				// a plain scalar runs until a comment, or the end of the item
+				n = len(b)
+				if i := bytes.Index(b, []byte(" #")); i >= 0 {
+					n = i
+				}
+				if depth > 0 {
+					if i := bytes.IndexAny(b[:n], ",[]{}"); i >= 0 {
+						n = i
+					}
+					if i := bytes.Index(b[:n], []byte(": ")); i >= 0 {
+						n = i
+					}
+				}
+				n = len(bytes.TrimRight(b[:n], " \t"))
+			}
+			sgr := c.String
+			if ch != '"' && ch != '\'' {
+				sgr = c.scalar(b[:n])
+			}
+			if depth > 0 {
+				if rest := bytes.TrimLeft(b[n:], " \t"); len(rest) > 0 && rest[0] == ':' {
+					sgr = c.Key
+				}
+			}
+			c.paint(w, sgr, b[:n])
+		}
+		b = b[n:]
+	}
+	return false
 }